@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/runner"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	log        logrus.Logger
-	version    = "0.0.0-src"
-	configFile = flag.String("config", "config.yml", "Config file location")
+	log             logrus.Logger
+	version         = "0.0.0-src"
+	configFile      = flag.String("config", "config.yml", "Config file location")
+	healthcheckMode = flag.Bool("healthcheck", false, "Check the health of a running agent and exit with 0 if it is healthy")
+	planMode        = flag.Bool("plan", false, "Print a JSON plan of what a cycle would change per item, without touching the output directory")
+	planCheckMode   = flag.Bool("plan-check", false, "Like --plan, but also run the playbooks of changed items with --check --diff")
+	onceMode        = flag.Bool("once", false, "Run a single cycle, print a JSON summary to stdout and exit with 0 if all items are OK, 2 if items failed and 3 if omnikeeper is unreachable")
 )
 
 func init() {
@@ -24,13 +34,75 @@ func init() {
 func main() {
 	flag.Parse()
 
+	// NOTE: flags may also follow the subcommand, e.g. validate-config --config config.yml
+	if flag.Arg(0) == "validate-config" {
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(validateConfig(*configFile))
+	}
+
+	if *healthcheckMode {
+		healthcheck.Check(*configFile)
+	}
+
 	log.Infof("omnikeeper-deploy-agent-sample (Version: %s)", version)
 
+	if *planMode || *planCheckMode {
+		plan, err := runner.RunPlan(SampleAppProcessor{}, *configFile, *planCheckMode, &log)
+		if err != nil {
+			log.Errorf("Error creating plan: %v", err)
+			os.Exit(runner.ExitCodeError)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		err = encoder.Encode(plan)
+		if err != nil {
+			log.Errorf("Error writing plan: %v", err)
+			os.Exit(runner.ExitCodeError)
+		}
+		if plan.Error != "" {
+			log.Errorf("%s", plan.Error)
+			os.Exit(runner.ExitCodeError)
+		}
+		os.Exit(runner.ExitCodeOK)
+	}
+
+	if *onceMode {
+		summary := runner.RunOnce(SampleAppProcessor{}, *configFile, &log)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		err := encoder.Encode(summary)
+		if err != nil {
+			log.Errorf("Error writing summary: %v", err)
+		}
+		os.Exit(summary.ExitCode())
+	}
+
 	runner.Run(SampleAppProcessor{}, *configFile, &log)
 
 	log.Infof("Stopping omnikeeper-deploy-agent-sample (Version: %s)", version)
 }
 
+// validateConfig prints every problem of the config file with its line, or the effective config with the source of every value, and returns the exit code
+func validateConfig(configFile string) int {
+	cfg := config.Configuration{}
+	err := config.ReadConfigFromFilename(configFile, &cfg)
+	var validationErrs config.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		for _, validationErr := range validationErrs {
+			fmt.Printf("%s: %s\n", configFile, validationErr)
+		}
+		return runner.ExitCodeError
+	} else if err != nil {
+		fmt.Printf("%s: %s\n", configFile, err)
+		return runner.ExitCodeError
+	}
+	fmt.Printf("%s: OK\n", configFile)
+	for _, value := range cfg.Describe() {
+		fmt.Printf("  %s = %s (%s)\n", value.Path, value.Value, value.Source)
+	}
+	return runner.ExitCodeOK
+}
+
 type SampleAppProcessor struct {
 }
 
@@ -59,8 +131,11 @@ func (p SampleAppProcessor) Process(configFile string, ctx context.Context, okCl
 // 	return ret, nil
 // }
 
+// PostProcess only logs the results, enable write_back in the config to record them in omnikeeper
 func (p SampleAppProcessor) PostProcess(configFile string, ctx context.Context, okClient *graphql.Client, log *logrus.Logger, results map[string]runner.ProcessResultItem) error {
-	println(results)
+	for id, result := range results {
+		log.Infof("Item %s: %s", id, result.Status)
+	}
 	return nil
 }
 
@@ -1,19 +1,31 @@
 package ansible
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/apenella/go-ansible/pkg/execute"
 	"github.com/apenella/go-ansible/pkg/playbook"
+	"github.com/apenella/go-ansible/pkg/stdoutcallback"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
 	"github.com/sirupsen/logrus"
 )
 
-func buildPlaybookCommand(config config.AnsibleCalloutConfig, id string, variableFile string, logWriter io.Writer) *playbook.AnsiblePlaybookCmd {
-	execute := execute.NewDefaultExecute(
-		execute.WithWrite(logWriter),
-	)
+// ErrTimeout is returned by Callout when a playbook run exceeds the configured item timeout
+var ErrTimeout = errors.New("playbook run timed out")
+
+func buildPlaybookCommand(config config.AnsibleCalloutConfig, id string, variableFile string, stdout io.Writer, stderr io.Writer, stdoutCallback string) *playbook.AnsiblePlaybookCmd {
+	execute := &processGroupExecute{
+		Write:      stdout,
+		WriteError: stderr,
+		Env:        []string{stdoutcallback.AnsibleStdoutCallbackEnv + "=" + stdoutCallback},
+	}
 
 	// clone/copy options to be able to change them independently in parallel setup
 	myAnsiblePlaybookOptions := *config.Options
@@ -38,34 +50,118 @@ func buildPlaybookCommand(config config.AnsibleCalloutConfig, id string, variabl
 		Options:           &myAnsiblePlaybookOptions,
 		Binary:            config.AnsibleBinary,
 		Exec:              execute,
+		StdoutCallback:    stdoutCallback,
 	}
 
 	return playbook
 }
 
-func Callout(ctx context.Context, config config.AnsibleCalloutConfig, id string, variableFile string, simulateOnly bool, log *logrus.Entry) error {
+// Callout runs the playbooks for an item and returns the structured results of the run
+// the result is nil if the playbooks were not run or their output could not be parsed, a run with failed tasks returns an error
+func Callout(ctx context.Context, config config.AnsibleCalloutConfig, id string, variableFile string, simulateOnly bool, log *logrus.Entry) (*Result, error) {
 
 	logWriter := log.Writer()
 	defer logWriter.Close()
 
-	playbook := buildPlaybookCommand(config, id, variableFile, logWriter)
+	// NOTE: stdout contains the results of the json stdout callback, stderr (warnings, ...) is logged as it is
+	var output bytes.Buffer
+	playbook := buildPlaybookCommand(config, id, variableFile, &output, logWriter, stdoutcallback.JSONStdoutCallback)
 
 	finalCommand, err := playbook.Command()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if simulateOnly {
 		log.Tracef("[SIMULATING] Calling playbook for item %s: %s", id, finalCommand)
 
 		// not actually calling playbook
-	} else {
-		log.Tracef("Calling playbook for item %s: %s", id, finalCommand)
+		return nil, nil
+	}
+
+	log.Tracef("Calling playbook for item %s: %s", id, finalCommand)
+	runErr := runPlaybook(ctx, config, playbook)
+
+	result, err := parseResult(bytes.NewReader(output.Bytes()))
+	if err != nil {
+		log.Warnf("Error parsing playbook results of item %s: %v", id, err)
+		_, _ = logWriter.Write(output.Bytes()) // raw output helps to find out what went wrong
+		return nil, runErr
+	}
+	logResult(result, log)
+	if runErr != nil && result.Failed() {
+		return result, fmt.Errorf("%w, failed tasks: %s", runErr, strings.Join(result.Errors(), "; "))
+	} else if runErr != nil {
+		return result, runErr
+	} else if result.Failed() {
+		return result, fmt.Errorf("playbook finished with failed tasks: %s", strings.Join(result.Errors(), "; "))
+	}
+	return result, nil
+}
 
-		err = playbook.Run(ctx)
-		if err != nil {
-			return err
+// logResult logs a line per task and host, so that the collected logs of an item stay readable
+func logResult(result *Result, log *logrus.Entry) {
+	for _, task := range result.Tasks {
+		if task.Status == TaskStatusFailed || task.Status == TaskStatusUnreachable {
+			log.Warnf("[%s] %s: %s %s", task.Host, task.Task, task.Status, task.Message)
+		} else {
+			log.Infof("[%s] %s: %s %s", task.Host, task.Task, task.Status, task.Message)
 		}
 	}
+	hosts := make([]string, 0, len(result.Hosts))
+	for host := range result.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		stats := result.Hosts[host]
+		log.Infof("[%s] ok=%d changed=%d failed=%d skipped=%d unreachable=%d ignored=%d rescued=%d",
+			host, stats.Ok, stats.Changed, stats.Failed, stats.Skipped, stats.Unreachable, stats.Ignored, stats.Rescued)
+	}
+}
+
+// Check runs the playbook for an item with --check --diff, which predicts changes without making them; ansible's output is written to output
+func Check(ctx context.Context, config config.AnsibleCalloutConfig, id string, variableFile string, output io.Writer, log *logrus.Entry) error {
+	writer := &syncWriter{w: output}
+	playbook := buildPlaybookCommand(config, id, variableFile, writer, writer, stdoutcallback.DefaultStdoutCallback)
+	playbook.Options.Check = true
+	playbook.Options.Diff = true
+
+	finalCommand, err := playbook.Command()
+	if err != nil {
+		return err
+	}
+	log.Tracef("Calling playbook in check mode for item %s: %s", id, finalCommand)
+
+	return runPlaybook(ctx, config, playbook)
+}
+
+// runPlaybook runs the playbook, killing it after the configured item timeout
+func runPlaybook(ctx context.Context, config config.AnsibleCalloutConfig, cmd *playbook.AnsiblePlaybookCmd) error {
+	runCtx := ctx
+	if config.ItemTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(config.ItemTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
 
+	err := cmd.Run(runCtx)
+	if err != nil {
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %d seconds", ErrTimeout, config.ItemTimeoutSeconds)
+		}
+		return err
+	}
 	return nil
 }
+
+// syncWriter serializes writes of ansible's stdout and stderr to a writer that is not safe for concurrent use
+type syncWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.w.Write(p)
+}
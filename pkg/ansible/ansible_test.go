@@ -2,13 +2,16 @@ package ansible
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/apenella/go-ansible/pkg/options"
 	"github.com/apenella/go-ansible/pkg/playbook"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCallout(t *testing.T) {
@@ -37,8 +40,78 @@ func TestCallout(t *testing.T) {
 
 	log := logrus.New()
 	log.Out = ioutil.Discard
-	err := Callout(ctx, cfg, "H12312312", "H12312312.json", false, logrus.NewEntry(log))
+	_, err := Callout(ctx, cfg, "H12312312", "H12312312.json", false, logrus.NewEntry(log))
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+// sample output of ansible's json stdout callback with a failed task
+const jsonCallbackOutput = `{
+    "custom_stats": {},
+    "global_custom_stats": {},
+    "plays": [
+        {
+            "play": {"name": "deploy", "id": "1", "duration": {"start": "", "end": ""}},
+            "tasks": [
+                {
+                    "task": {"name": "install package", "id": "2", "duration": {"start": "", "end": ""}},
+                    "hosts": {"target-host-a": {"action": "apt", "changed": true, "msg": ""}}
+                },
+                {
+                    "task": {"name": "optional step", "id": "3", "duration": {"start": "", "end": ""}},
+                    "hosts": {"target-host-a": {"action": "command", "changed": false, "skipped": true, "skip_reason": "Conditional result was False"}}
+                },
+                {
+                    "task": {"name": "start service", "id": "4", "duration": {"start": "", "end": ""}},
+                    "hosts": {"target-host-a": {"action": "service", "changed": false, "failed": true, "msg": "Could not find the requested service foo"}}
+                }
+            ]
+        }
+    ],
+    "stats": {
+        "target-host-a": {"changed": 1, "failures": 1, "ignored": 0, "ok": 1, "rescued": 0, "skipped": 1, "unreachable": 0}
+    }
+}`
+
+func TestCalloutParsesJSONResults(t *testing.T) {
+	ctx := context.Background()
+
+	// fake ansible-playbook that prints json callback output, fails if the json callback is not requested
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "output.json")
+	err := ioutil.WriteFile(outputFile, []byte(jsonCallbackOutput), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "ansible-playbook")
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$ANSIBLE_STDOUT_CALLBACK\" = json ] || exit 5\ncat %s\nexit 2\n", outputFile)
+	err = ioutil.WriteFile(binary, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.AnsibleCalloutConfig{
+		Playbooks:     []string{"../../contrib/sample-playbook.yml"},
+		Options:       &playbook.AnsiblePlaybookOptions{},
+		AnsibleBinary: binary,
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	result, err := Callout(ctx, cfg, "H12312312", "H12312312.json", false, logrus.NewEntry(log))
+
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "exit status 5")
+	assert.Contains(t, err.Error(), "Could not find the requested service foo")
+	if assert.NotNil(t, result) {
+		assert.True(t, result.Failed())
+		assert.Equal(t, map[string]HostStats{"target-host-a": {Ok: 1, Changed: 1, Failed: 1, Skipped: 1}}, result.Hosts)
+		assert.Equal(t, []TaskResult{
+			{Play: "deploy", Task: "install package", Host: "target-host-a", Status: TaskStatusChanged},
+			{Play: "deploy", Task: "optional step", Host: "target-host-a", Status: TaskStatusSkipped, Message: "Conditional result was False"},
+			{Play: "deploy", Task: "start service", Host: "target-host-a", Status: TaskStatusFailed, Message: "Could not find the requested service foo"},
+		}, result.Tasks)
+		assert.Equal(t, []string{"[target-host-a] start service: Could not find the requested service foo"}, result.Errors())
+	}
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apenella/go-ansible/pkg/playbook"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalloutTimeoutKillsProcessGroup(t *testing.T) {
+	ctx := context.Background()
+
+	// fake ansible-playbook that spawns a long running child process and records its pid
+	dir := t.TempDir()
+	childPidFile := filepath.Join(dir, "child.pid")
+	binary := filepath.Join(dir, "ansible-playbook")
+	script := fmt.Sprintf("#!/bin/sh\nsleep 60 &\necho $! > %s\nwait\n", childPidFile)
+	err := ioutil.WriteFile(binary, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.AnsibleCalloutConfig{
+		Playbooks:          []string{"../../contrib/sample-playbook.yml"},
+		Options:            &playbook.AnsiblePlaybookOptions{},
+		AnsibleBinary:      binary,
+		ItemTimeoutSeconds: 1,
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	start := time.Now()
+	_, err = Callout(ctx, cfg, "H12312312", "H12312312.json", false, logrus.NewEntry(log))
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	childPid, err := ioutil.ReadFile(childPidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(childPid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		// signal 0 only checks for existence of the process
+		return syscall.Kill(pid, 0) != nil
+	}, 5*time.Second, 50*time.Millisecond, "child process of timed out playbook is still running")
+}
@@ -0,0 +1,91 @@
+package ansible
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/apenella/go-ansible/pkg/execute"
+	"github.com/apenella/go-ansible/pkg/stdoutcallback"
+	"github.com/apenella/go-ansible/pkg/stdoutcallback/results"
+)
+
+// processGroupExecute is an execute.Executor that starts ansible-playbook in its own process group
+// when the context is done, the whole process tree (forks, ssh connections, ...) is killed, not only the ansible-playbook process
+type processGroupExecute struct {
+	Write      io.Writer
+	WriteError io.Writer
+	Env        []string // added to the environment of the agent, e.g. ANSIBLE_STDOUT_CALLBACK=json
+}
+
+func (e *processGroupExecute) Execute(ctx context.Context, command []string, resultsFunc stdoutcallback.StdoutCallbackResultsFunc, options ...execute.ExecuteOptions) error {
+	if resultsFunc == nil {
+		resultsFunc = results.DefaultStdoutCallbackResults
+	}
+	if e.Write == nil {
+		e.Write = os.Stdout
+	}
+	if e.WriteError == nil {
+		e.WriteError = os.Stderr
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	setProcessGroup(cmd)
+	if len(e.Env) > 0 {
+		// NOTE: later entries take precedence, which overrides variables that go-ansible sets process-wide
+		cmd.Env = append(os.Environ(), e.Env...)
+	}
+
+	cmdStdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Error creating stdout pipe: %w", err)
+	}
+	cmdStderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("Error creating stderr pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Error starting command: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	// NOTE: output is read until EOF, which happens at the latest when the process group is killed
+	var wg sync.WaitGroup
+	var resultsErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		resultsErr = resultsFunc(context.Background(), cmdStdout, e.Write)
+	}()
+	go func() {
+		defer wg.Done()
+		_ = results.DefaultStdoutCallbackResults(context.Background(), cmdStderr, e.WriteError)
+	}()
+	wg.Wait()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("Error during command execution %s: %w", cmd.String(), err)
+	}
+	if resultsErr != nil {
+		return fmt.Errorf("Error processing command output: %w", resultsErr)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package ansible
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// NOTE: process groups are not supported on windows, only the ansible process itself is killed
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	_ = cmd.Process.Kill()
+}
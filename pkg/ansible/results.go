@@ -0,0 +1,166 @@
+package ansible
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/apenella/go-ansible/pkg/stdoutcallback/results"
+)
+
+type TaskStatus string
+
+const (
+	TaskStatusOk          TaskStatus = "ok"
+	TaskStatusChanged     TaskStatus = "changed"
+	TaskStatusFailed      TaskStatus = "failed"
+	TaskStatusSkipped     TaskStatus = "skipped"
+	TaskStatusUnreachable TaskStatus = "unreachable"
+)
+
+// Result is the structured outcome of a playbook run, parsed from the output of ansible's json stdout callback
+type Result struct {
+	Hosts map[string]HostStats `json:"hosts"` // play recap per host
+	Tasks []TaskResult         `json:"tasks"` // one entry per task and host, in the order of execution
+}
+
+type HostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failed      int `json:"failed"`
+	Skipped     int `json:"skipped"`
+	Unreachable int `json:"unreachable"`
+	Ignored     int `json:"ignored"`
+	Rescued     int `json:"rescued"`
+}
+
+type TaskResult struct {
+	Play    string     `json:"play"`
+	Task    string     `json:"task"`
+	Host    string     `json:"host"`
+	Status  TaskStatus `json:"status"`
+	Message string     `json:"message,omitempty"`
+}
+
+// Failed returns whether any host had failed or unreachable tasks
+func (r *Result) Failed() bool {
+	for _, stats := range r.Hosts {
+		if stats.Failed > 0 || stats.Unreachable > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returns the messages of all failed and unreachable tasks
+func (r *Result) Errors() []string {
+	errs := make([]string, 0)
+	for _, task := range r.Tasks {
+		if task.Status == TaskStatusFailed || task.Status == TaskStatusUnreachable {
+			errs = append(errs, fmt.Sprintf("[%s] %s: %s", task.Host, task.Task, task.Message))
+		}
+	}
+	return errs
+}
+
+// parseResult parses the output of ansible's json stdout callback
+func parseResult(output io.Reader) (*Result, error) {
+	parsed, err := results.ParseJSONResultsStream(output)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Hosts: make(map[string]HostStats, len(parsed.Stats)),
+		Tasks: make([]TaskResult, 0),
+	}
+	for host, stats := range parsed.Stats {
+		if stats == nil {
+			continue
+		}
+		result.Hosts[host] = HostStats{
+			Ok:          stats.Ok,
+			Changed:     stats.Changed,
+			Failed:      stats.Failures,
+			Skipped:     stats.Skipped,
+			Unreachable: stats.Unreachable,
+			Ignored:     stats.Ignored,
+			Rescued:     stats.Rescued,
+		}
+	}
+	for _, play := range parsed.Plays {
+		playName := ""
+		if play.Play != nil {
+			playName = play.Play.Name
+		}
+		for _, task := range play.Tasks {
+			taskName := ""
+			if task.Task != nil {
+				taskName = task.Task.Name
+			}
+			// NOTE: hosts are sorted, so the result does not depend on map ordering
+			hosts := make([]string, 0, len(task.Hosts))
+			for host := range task.Hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			for _, host := range hosts {
+				hostResult := task.Hosts[host]
+				if hostResult == nil {
+					continue
+				}
+				result.Tasks = append(result.Tasks, TaskResult{
+					Play:    playName,
+					Task:    taskName,
+					Host:    host,
+					Status:  taskStatus(hostResult),
+					Message: taskMessage(hostResult),
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+func taskStatus(hostResult *results.AnsiblePlaybookJSONResultsPlayTaskHostsItem) TaskStatus {
+	switch {
+	case hostResult.Unreachable:
+		return TaskStatusUnreachable
+	case hostResult.Failed:
+		return TaskStatusFailed
+	case hostResult.Skipped:
+		return TaskStatusSkipped
+	case hostResult.Changed:
+		return TaskStatusChanged
+	default:
+		return TaskStatusOk
+	}
+}
+
+// taskMessage returns the msg of a task result, falling back to stderr for failed commands
+func taskMessage(hostResult *results.AnsiblePlaybookJSONResultsPlayTaskHostsItem) string {
+	message := stringify(hostResult.Msg)
+	if message == "" && (hostResult.Failed || hostResult.Unreachable) {
+		message = stringify(hostResult.Stderr)
+	}
+	if message == "" && hostResult.Skipped {
+		message = hostResult.SkipReason
+	}
+	return message
+}
+
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(content)
+	}
+}
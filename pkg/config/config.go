@@ -1,20 +1,75 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/apenella/go-ansible/pkg/options"
 	"github.com/apenella/go-ansible/pkg/playbook"
 	"gopkg.in/yaml.v3"
 )
 
+// ReadConfigFromBytes parses the config strictly, applies the environment overrides (see EnvPrefix), fills in the defaults and validates it
+// all problems, including unknown fields, are returned at once as ValidationErrors with the YAML path and line of every problem
 func ReadConfigFromBytes(byteValue []byte, cfg *Configuration) error {
-	err := yaml.Unmarshal(byteValue, &cfg)
+	var root yaml.Node
+	err := yaml.Unmarshal(byteValue, &root)
 	if err != nil {
 		return fmt.Errorf("can't parse config file: %w", err)
 	}
+	index := newNodeIndex(&root)
+
+	errs := ValidationErrors{}
+	decoder := yaml.NewDecoder(bytes.NewReader(byteValue))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		// NOTE: the decoder continues after type errors, so the remaining fields can still be validated
+		errs = append(errs, index.typeErrors(typeErr)...)
+	} else if err != nil && err != io.EOF {
+		return fmt.Errorf("can't parse config file: %w", err)
+	}
+
+	cfg.Sources = make(map[string]string)
+	cfg.recordFileSources(index)
+	errs = append(errs, cfg.applyEnvOverrides(os.LookupEnv)...)
+	errs = append(errs, cfg.resolveSecretFiles()...)
+
+	unset := cfg.zeroFields()
+	for path := range cfg.Sources {
+		// NOTE: a zero from the config file or the environment is a value of its own, even if SetDefaults replaces it
+		delete(unset, path)
+	}
+	cfg.SetDefaults()
+	for path := range cfg.zeroFields() {
+		delete(unset, path)
+	}
+	for path := range unset {
+		cfg.Sources[path] = SourceDefault
+	}
+
+	var validationErrs ValidationErrors
+	if errors.As(cfg.Validate(), &validationErrs) {
+		for _, validationErr := range validationErrs {
+			if source, ok := cfg.Sources[validationErr.Path]; ok && !strings.HasPrefix(source, "config file") {
+				// NOTE: the line of the config file would be misleading for values from other sources
+				validationErr.Message = fmt.Sprintf("%s (from %s)", validationErr.Message, source)
+			} else {
+				validationErr.Line = index.line(validationErr.Path)
+			}
+			errs = append(errs, validationErr)
+		}
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return errs
+	}
 	return nil
 }
 
@@ -36,14 +91,110 @@ func ReadConfigFromFilename(configFile string, cfg *Configuration) error {
 type Configuration struct {
 	LogLevel                     string               `yaml:"log_level"`
 	Username                     string               `yaml:"username"`
-	Password                     string               `yaml:"password"`
+	Password                     string               `yaml:"password" secret:"true"`
+	PasswordFile                 string               `yaml:"password_file"` // the password is read from this file, takes precedence over password
 	OmnikeeperBackendUrl         string               `yaml:"omnikeeper_backend_url"`
 	OmnikeeperInsecureSkipVerify bool                 `yaml:"omnikeeper_insecure_skip_verify"`
+	OmnikeeperCAFile             string               `yaml:"omnikeeper_ca_file"`          // PEM bundle of CAs trusted in addition to the system CAs
+	OmnikeeperClientCertFile     string               `yaml:"omnikeeper_client_cert_file"` // PEM client certificate for mutual TLS, requires omnikeeper_client_key_file
+	OmnikeeperClientKeyFile      string               `yaml:"omnikeeper_client_key_file"`
+	OmnikeeperServerName         string               `yaml:"omnikeeper_server_name"` // overrides the server name used for certificate verification and SNI
 	KeycloakClientId             string               `yaml:"keycloak_client_id"`
+	Auth                         AuthConfig           `yaml:"auth"`
 	CollectIntervalSeconds       int                  `yaml:"collect_interval_seconds"`
+	ConfigReloadIntervalSeconds  int                  `yaml:"config_reload_interval_seconds"` // the config file is checked for changes in this interval, defaults to 10; <= 0 disables polling, SIGHUP always reloads
 	HealthcheckThresholdSeconds  int64                `yaml:"healthcheck_threshold_seconds"`
+	HealthcheckStatFile          string               `yaml:"healthcheck_stat_file"`        // defaults to /tmp/healthcheck_stat
+	HealthcheckMaxFailedRatio    float64              `yaml:"healthcheck_max_failed_ratio"` // /readyz fails if a larger share of items failed in the last cycle, defaults to 0.5; 0 fails on any failed item
 	OutputDirectory              string               `yaml:"output_directory"`
+	OutputFormat                 string               `yaml:"output_format"`                 // format of the variables files: json (default), yaml or dotenv
+	OutputFileMode               string               `yaml:"output_file_mode"`              // octal permissions of the variables files, defaults to 0600
+	OutputDirectoryMode          string               `yaml:"output_directory_mode"`         // octal permissions of the output directory, defaults to 0700
+	OutputDirectoryLock          bool                 `yaml:"output_directory_lock"`         // lock the output directory so that no other agent can use it at the same time
+	ShutdownGracePeriodSeconds   int                  `yaml:"shutdown_grace_period_seconds"` // running playbooks are cancelled this long after a shutdown signal, defaults to 25; 0 cancels them right away
+	HTTPListenAddress            string               `yaml:"http_listen_address"`           // optional listener serving /metrics, /healthz and /readyz, e.g. ":9100"
 	Ansible                      AnsibleCalloutConfig `yaml:"ansible"`
+	Retry                        RetryConfig          `yaml:"retry"`
+	Subscription                 SubscriptionConfig   `yaml:"subscription"`
+	API                          APIConfig            `yaml:"api"`
+	WriteBack                    WriteBackConfig      `yaml:"write_back"`
+	ItemLogs                     ItemLogConfig        `yaml:"item_logs"`
+	Cleanup                      CleanupConfig        `yaml:"cleanup"`
+
+	Sources map[string]string `yaml:"-"` // source of every value by YAML path, see ConfigValue.Source
+}
+
+// ItemLogConfig limits the log lines that are collected per item and cycle, of longer logs the first and the last lines are kept
+type ItemLogConfig struct {
+	MaxLines int `yaml:"max_lines"` // defaults to 1000
+	MaxBytes int `yaml:"max_bytes"` // defaults to 262144
+}
+
+// CleanupConfig protects the variables files of items that are not returned by the processor anymore
+type CleanupConfig struct {
+	MaxRemovedRatio    float64 `yaml:"max_removed_ratio"`    // a cycle fails without changes if a larger share of the known items would be removed, defaults to 0.5; 0 only removes forced items, 1 disables the check
+	MinRemovedItems    int     `yaml:"min_removed_items"`    // max_removed_ratio is only enforced if at least this many items would be removed, defaults to 2, so small inventories can remove single items
+	GracePeriodSeconds int     `yaml:"grace_period_seconds"` // the files of removed items are deleted after they were missing for this long, 0 deletes them right away
+}
+
+// WriteBackConfig enables writing the result of every playbook run back to the item's CI in omnikeeper
+type WriteBackConfig struct {
+	Enabled     bool                `yaml:"enabled"`
+	Layer       string              `yaml:"layer"`
+	ReadLayers  []string            `yaml:"read_layers"`   // defaults to layer
+	BatchSize   int                 `yaml:"batch_size"`    // CIs per mutation, defaults to 50
+	MaxLogBytes int                 `yaml:"max_log_bytes"` // the log is truncated at the beginning to this size, defaults to 16384
+	Mutation    string              `yaml:"mutation"`      // GraphQL mutation with $writeLayer, $readLayers and $insertAttributes variables, defaults to omnikeeper.DefaultWriteBackMutation
+	Attributes  WriteBackAttributes `yaml:"attributes"`
+}
+
+// WriteBackAttributes are the names of the attributes that are written, empty names use the defaults
+type WriteBackAttributes struct {
+	LastDeployTime string `yaml:"last_deploy_time"` // defaults to okda.last_deploy_time
+	Success        string `yaml:"success"`          // defaults to okda.success
+	Log            string `yaml:"log"`              // defaults to okda.log
+	VariablesHash  string `yaml:"variables_hash"`   // defaults to okda.variables_hash
+}
+
+// APIConfig enables the HTTP API for triggering cycles and inspecting items, every request must carry the token as bearer token
+type APIConfig struct {
+	ListenAddress string `yaml:"listen_address"` // e.g. "127.0.0.1:9101", the API is disabled if empty
+	Token         string `yaml:"token" secret:"true"`
+	TokenFile     string `yaml:"token_file"` // read once at startup, takes precedence over token
+}
+
+// SubscriptionConfig enables cycles triggered by omnikeeper change notifications, polling with collect_interval_seconds continues as fallback
+type SubscriptionConfig struct {
+	Enabled               bool     `yaml:"enabled"`
+	Layers                []string `yaml:"layers"`
+	Query                 string   `yaml:"query"`                   // GraphQL subscription with a $layers variable, defaults to omnikeeper.DefaultSubscriptionQuery
+	DebounceSeconds       int      `yaml:"debounce_seconds"`        // wait for this long without further notifications before starting a cycle, defaults to 5
+	ReconnectDelaySeconds int      `yaml:"reconnect_delay_seconds"` // defaults to 30
+}
+
+const (
+	AuthModePassword          = "password"           // resource owner password grant with username and password
+	AuthModeClientCredentials = "client_credentials" // client credentials grant with client_secret or private_key_jwt
+	AuthModeTokenFile         = "token_file"         // pre-issued bearer token, re-read whenever the file changes
+)
+
+// AuthConfig selects how the agent authenticates against omnikeeper; keycloak_client_id is used as client ID
+type AuthConfig struct {
+	Mode             string   `yaml:"mode"` // defaults to password
+	ClientSecret     string   `yaml:"client_secret" secret:"true"`
+	ClientSecretFile string   `yaml:"client_secret_file"` // the client secret is read from this file, takes precedence over client_secret
+	PrivateKeyFile   string   `yaml:"private_key_file"`   // PEM encoded RSA key for private_key_jwt client authentication, used instead of client_secret
+	PrivateKeyID     string   `yaml:"private_key_id"`     // optional kid header of the client assertion
+	Scopes           []string `yaml:"scopes"`
+	TokenFile        string   `yaml:"token_file"`
+}
+
+// RetryConfig controls how items with failed playbook runs are retried
+type RetryConfig struct {
+	BackoffBaseSeconds      int     `yaml:"backoff_base_seconds"`      // delay after the first failure, doubled with every further failure; <= 0 retries in every cycle
+	BackoffMaxSeconds       int     `yaml:"backoff_max_seconds"`       // upper limit of the delay; <= 0 means no limit
+	BackoffJitter           float64 `yaml:"backoff_jitter"`            // randomizes the delay by +/- this fraction, e.g. 0.2
+	QuarantineAfterFailures int     `yaml:"quarantine_after_failures"` // stop retrying after this many consecutive failures until the item's data changes; <= 0 disables quarantine
 }
 
 type AnsibleCalloutConfig struct {
@@ -53,4 +204,7 @@ type AnsibleCalloutConfig struct {
 	ConnectionOptions  *options.AnsibleConnectionOptions `yaml:"connection_options"`
 	AnsibleBinary      string                            `yaml:"ansible_binary"`
 	ParallelProcessing bool                              `yaml:"parallel_processing"`
+	ItemTimeoutSeconds int                               `yaml:"item_timeout_seconds"` // per-item deadline for a playbook run; <= 0 means no timeout
+	MaxParallel        int                               `yaml:"max_parallel"`         // upper limit of concurrent playbook runs when parallel_processing is enabled; <= 0 means runtime.NumCPU()
+	RemovalPlaybooks   []string                          `yaml:"removal_playbooks"`    // run once for every item that is not returned anymore, with its last variables file, before its files are deleted
 }
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables that override config values
+// the name of a variable is the YAML path of its field in upper case with dots replaced by underscores, e.g. OKDA_ANSIBLE_MAX_PARALLEL for ansible.max_parallel
+// with the suffix _FILE, the value is read from the named file instead, e.g. OKDA_PASSWORD_FILE=/var/run/secrets/okda/password
+const EnvPrefix = "OKDA_"
+
+const redacted = "[redacted]"
+
+// SourceDefault is the source of values that were filled in by SetDefaults, see Configuration.Sources
+const SourceDefault = "default"
+
+// ConfigValue is a single effective value of a configuration, see Configuration.Describe
+type ConfigValue struct {
+	Path   string
+	Value  string // secrets are redacted
+	Source string // e.g. "config file, line 3", "env OKDA_PASSWORD", "file /run/secrets/password (OKDA_PASSWORD_FILE)" or "default"
+}
+
+// leafField is a field of Configuration that holds a value, i.e. that is not a nested struct
+type leafField struct {
+	path   string
+	env    string
+	index  []int
+	secret bool
+}
+
+// leafFields returns all fields of Configuration that can be overridden, nested structs are flattened
+func leafFields() []leafField {
+	fields := make([]leafField, 0)
+	collectLeafFields(reflect.TypeOf(Configuration{}), "", nil, &fields)
+	return fields
+}
+
+func collectLeafFields(t reflect.Type, path string, index []int, fields *[]leafField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			// NOTE: same default as yaml.v3
+			name = strings.ToLower(f.Name)
+		}
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+
+		fieldType := f.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			collectLeafFields(fieldType, fieldPath, fieldIndex, fields)
+			continue
+		}
+		*fields = append(*fields, leafField{
+			path:   fieldPath,
+			env:    EnvPrefix + strings.ToUpper(strings.ReplaceAll(fieldPath, ".", "_")),
+			index:  fieldIndex,
+			secret: f.Tag.Get("secret") == "true",
+		})
+	}
+}
+
+// fieldValue returns the value of the field, nil pointers to nested structs are allocated if allocate is set
+func fieldValue(cfg *Configuration, index []int, allocate bool) (reflect.Value, bool) {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !allocate {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// setFieldValue sets a string field to value as is, all other fields are parsed from YAML, e.g. "[a, b]" for lists
+func setFieldValue(cfg *Configuration, field leafField, value string) error {
+	v, _ := fieldValue(cfg, field.index, true)
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+	parsed := reflect.New(v.Type())
+	err := yaml.Unmarshal([]byte(value), parsed.Interface())
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		// NOTE: the value is a single line, the line number is noise
+		return errors.New(strings.TrimPrefix(typeErr.Errors[0], "line 1: "))
+	}
+	if err != nil {
+		return err
+	}
+	v.Set(parsed.Elem())
+	return nil
+}
+
+// recordFileSources records every field that is set in the config file as source
+func (c *Configuration) recordFileSources(index nodeIndex) {
+	for _, field := range leafFields() {
+		if line, ok := index.lines[field.path]; ok {
+			c.Sources[field.path] = fmt.Sprintf("config file, line %d", line)
+		}
+	}
+}
+
+// applyEnvOverrides overrides all fields that have an environment variable set, lookup is usually os.LookupEnv
+func (c *Configuration) applyEnvOverrides(lookup func(string) (string, bool)) ValidationErrors {
+	errs := ValidationErrors{}
+	fields := leafFields()
+	envNames := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		envNames[field.env] = true
+	}
+
+	for _, field := range fields {
+		value, ok := lookup(field.env)
+		source := "env " + field.env
+		// NOTE: if a field with the name of the _FILE variable exists, the variable belongs to that field, e.g. OKDA_PASSWORD_FILE
+		fileEnv := field.env + "_FILE"
+		if filename, fileOk := lookup(fileEnv); fileOk && !envNames[fileEnv] {
+			if ok {
+				errs = append(errs, ValidationError{Path: field.path, Message: fmt.Sprintf("only one of %s and %s may be set", field.env, fileEnv)})
+				continue
+			}
+			content, err := readSecretFile(filename)
+			if err != nil {
+				errs = append(errs, ValidationError{Path: field.path, Message: fmt.Sprintf("can't read %s: %v", fileEnv, err)})
+				continue
+			}
+			value, ok, source = content, true, fmt.Sprintf("file %s (%s)", filename, fileEnv)
+		}
+		if !ok {
+			continue
+		}
+
+		err := setFieldValue(c, field, value)
+		if err != nil {
+			errs = append(errs, ValidationError{Path: field.path, Message: fmt.Sprintf("can't parse %s: %v", field.env, err)})
+			continue
+		}
+		c.Sources[field.path] = source
+	}
+	return errs
+}
+
+// resolveSecretFiles reads the secrets of password_file and auth.client_secret_file, secrets that were set by environment variables take precedence
+func (c *Configuration) resolveSecretFiles() ValidationErrors {
+	errs := ValidationErrors{}
+	secretFiles := []struct {
+		path     string
+		filename string
+		value    *string
+	}{
+		{"password", c.PasswordFile, &c.Password},
+		{"auth.client_secret", c.Auth.ClientSecretFile, &c.Auth.ClientSecret},
+	}
+	for _, secretFile := range secretFiles {
+		if secretFile.filename == "" || strings.Contains(c.Sources[secretFile.path], EnvPrefix) {
+			continue
+		}
+		content, err := readSecretFile(secretFile.filename)
+		if err != nil {
+			errs = append(errs, ValidationError{Path: secretFile.path + "_file", Message: fmt.Sprintf("can't read secret file: %v", err)})
+			continue
+		}
+		*secretFile.value = content
+		c.Sources[secretFile.path] = fmt.Sprintf("file %s (%s_file)", secretFile.filename, secretFile.path)
+	}
+	return errs
+}
+
+// readSecretFile returns the content of the file without trailing line breaks, as added by most editors and kubectl
+func readSecretFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// zeroFields returns the paths of all fields that are not set
+func (c *Configuration) zeroFields() map[string]bool {
+	zero := make(map[string]bool)
+	for _, field := range leafFields() {
+		v, ok := fieldValue(c, field.index, false)
+		if !ok || v.IsZero() {
+			zero[field.path] = true
+		}
+	}
+	return zero
+}
+
+// Describe returns all values that are set with their source, secrets, values read from files and the values of maps are redacted
+func (c Configuration) Describe() []ConfigValue {
+	values := make([]ConfigValue, 0)
+	for _, field := range leafFields() {
+		v, ok := fieldValue(&c, field.index, false)
+		source := c.Sources[field.path]
+		if !ok || (v.IsZero() && source == "") {
+			continue
+		}
+
+		value := ""
+		switch {
+		case (field.secret || strings.HasPrefix(source, "file ")) && !v.IsZero():
+			value = redacted
+		case v.Kind() == reflect.Map:
+			// NOTE: maps like ansible.options.extravars may carry secrets, only their keys are shown
+			value = redactedMap(v)
+		case v.Kind() == reflect.String:
+			value = v.String()
+		default:
+			formatted, err := json.Marshal(v.Interface())
+			if err != nil {
+				formatted = []byte(fmt.Sprintf("%v", v.Interface()))
+			}
+			value = string(formatted)
+		}
+		values = append(values, ConfigValue{Path: field.path, Value: value, Source: source})
+	}
+	return values
+}
+
+// redactedMap formats a map as JSON object with all values redacted
+func redactedMap(v reflect.Value) string {
+	keys := make(map[string]string, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		keys[fmt.Sprintf("%v", iter.Key().Interface())] = redacted
+	}
+	formatted, _ := json.Marshal(keys)
+	return string(formatted)
+}
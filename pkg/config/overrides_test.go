@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvNamesAreUnique(t *testing.T) {
+	names := make(map[string]string)
+	for _, field := range leafFields() {
+		assert.NotContains(t, names, field.env, "%s and %s", field.path, names[field.env])
+		names[field.env] = field.path
+	}
+	assert.Equal(t, "ansible.connection_options.privatekey", names["OKDA_ANSIBLE_CONNECTION_OPTIONS_PRIVATEKEY"])
+}
+
+func TestEnvOverrides(t *testing.T) {
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	assert.NoError(t, ioutil.WriteFile(usernameFile, []byte("user-from-file\n"), 0600))
+
+	t.Setenv("OKDA_PASSWORD", "s3cret")
+	t.Setenv("OKDA_USERNAME_FILE", usernameFile)
+	t.Setenv("OKDA_ANSIBLE_MAX_PARALLEL", "4")
+	t.Setenv("OKDA_ANSIBLE_PLAYBOOKS", "[site.yml, deploy.yml]")
+	t.Setenv("OKDA_ANSIBLE_OPTIONS_EXTRAVARS", "{env: prod}")
+
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "s3cret", cfg.Password)
+	assert.Equal(t, "user-from-file", cfg.Username)
+	assert.Equal(t, 4, cfg.Ansible.MaxParallel)
+	assert.Equal(t, []string{"site.yml", "deploy.yml"}, cfg.Ansible.Playbooks)
+	assert.Equal(t, map[string]interface{}{"env": "prod"}, cfg.Ansible.Options.ExtraVars)
+	// untouched values of nested structs are kept
+	assert.Equal(t, "target-host-a,", cfg.Ansible.Options.Inventory)
+
+	values := make(map[string]ConfigValue)
+	for _, value := range cfg.Describe() {
+		values[value.Path] = value
+	}
+	assert.Equal(t, ConfigValue{Path: "password", Value: "[redacted]", Source: "env OKDA_PASSWORD"}, values["password"])
+	assert.Equal(t, ConfigValue{Path: "username", Value: "[redacted]", Source: "file " + usernameFile + " (OKDA_USERNAME_FILE)"}, values["username"])
+	assert.Equal(t, ConfigValue{Path: "ansible.max_parallel", Value: "4", Source: "env OKDA_ANSIBLE_MAX_PARALLEL"}, values["ansible.max_parallel"])
+	assert.Equal(t, ConfigValue{Path: "output_directory", Value: "./output", Source: "config file, line 9"}, values["output_directory"])
+	assert.Equal(t, ConfigValue{Path: "shutdown_grace_period_seconds", Value: "25", Source: SourceDefault}, values["shutdown_grace_period_seconds"])
+	assert.Equal(t, ConfigValue{Path: "ansible.options.extravars", Value: `{"env":"[redacted]"}`, Source: "env OKDA_ANSIBLE_OPTIONS_EXTRAVARS"}, values["ansible.options.extravars"])
+}
+
+func TestSourcesOfDefaultedValues(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig+"item_logs:\n  max_lines: 0\n"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultItemLogMaxLines, cfg.ItemLogs.MaxLines)
+
+	values := make(map[string]ConfigValue)
+	for _, value := range cfg.Describe() {
+		values[value.Path] = value
+	}
+	assert.Regexp(t, "^config file, line [0-9]+$", values["item_logs.max_lines"].Source)
+	assert.Equal(t, SourceDefault, values["item_logs.max_bytes"].Source)
+}
+
+func TestSecretFiles(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig+"password_file: "+passwordFile+"\n"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", cfg.Password)
+
+	// the environment takes precedence over the config file
+	t.Setenv("OKDA_PASSWORD", "from-env")
+	cfg = Configuration{}
+	err = ReadConfigFromBytes([]byte(inputConfig+"password_file: "+passwordFile+"\n"), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", cfg.Password)
+}
+
+func TestEnvOverrideErrors(t *testing.T) {
+	t.Setenv("OKDA_COLLECT_INTERVAL_SECONDS", "0")
+	t.Setenv("OKDA_ANSIBLE_MAX_PARALLEL", "many")
+	t.Setenv("OKDA_USERNAME", "u")
+	t.Setenv("OKDA_USERNAME_FILE", "/nonexistent")
+
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig), &cfg)
+
+	var errs ValidationErrors
+	if assert.True(t, errors.As(err, &errs), err) {
+		assert.Equal(t, ValidationErrors{
+			{Path: "username", Message: "only one of OKDA_USERNAME and OKDA_USERNAME_FILE may be set"},
+			{Path: "ansible.max_parallel", Message: "can't parse OKDA_ANSIBLE_MAX_PARALLEL: cannot unmarshal !!str `many` into int"},
+			{Path: "collect_interval_seconds", Message: "must be greater than 0 (from env OKDA_COLLECT_INTERVAL_SECONDS)"},
+		}, errs)
+	}
+}
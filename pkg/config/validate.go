@@ -0,0 +1,408 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apenella/go-ansible/pkg/options"
+	"github.com/apenella/go-ansible/pkg/playbook"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/variables"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// documented defaults, see SetDefaults
+const (
+	DefaultHealthcheckStatFile               = "/tmp/healthcheck_stat"
+	DefaultHealthcheckMaxFailedRatio         = 0.5
+	DefaultConfigReloadIntervalSeconds       = 10
+	DefaultShutdownGracePeriodSeconds        = 25
+	DefaultOutputFormat                      = variables.FormatJSON
+	DefaultOutputFileMode                    = "0600"
+	DefaultOutputDirectoryMode               = "0700"
+	DefaultItemLogMaxLines                   = 1000
+	DefaultItemLogMaxBytes                   = 256 * 1024
+	DefaultWriteBackBatchSize                = 50
+	DefaultWriteBackMaxLogBytes              = 16384
+	DefaultLastDeployTimeAttribute           = "okda.last_deploy_time"
+	DefaultSuccessAttribute                  = "okda.success"
+	DefaultLogAttribute                      = "okda.log"
+	DefaultVariablesHashAttribute            = "okda.variables_hash"
+	DefaultSubscriptionDebounceSeconds       = 5
+	DefaultSubscriptionReconnectDelaySeconds = 30
+	DefaultCleanupMaxRemovedRatio            = 0.5
+	DefaultCleanupMinRemovedItems            = 2
+)
+
+// ValidationError is a single problem of a configuration
+type ValidationError struct {
+	Path    string // YAML path of the field, e.g. ansible.playbooks[0]
+	Line    int    // line of the field in the config file, 0 if unknown or the field is missing
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors are all problems of a configuration, sorted by line
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("invalid config: %s", strings.Join(messages, "; "))
+}
+
+// SetDefaults fills in the documented defaults of all fields that are not set
+// defaults that live in other packages, like the write-back mutation or the subscription query, are left empty
+// NOTE: numbers for which 0 has a meaning of its own keep an explicit 0 if their source is recorded in Sources
+func (c *Configuration) SetDefaults() {
+	if c.Auth.Mode == "" {
+		c.Auth.Mode = AuthModePassword
+	}
+	if c.HealthcheckStatFile == "" {
+		c.HealthcheckStatFile = DefaultHealthcheckStatFile
+	}
+	if c.unset("healthcheck_max_failed_ratio", c.HealthcheckMaxFailedRatio == 0) {
+		c.HealthcheckMaxFailedRatio = DefaultHealthcheckMaxFailedRatio
+	}
+	if c.unset("config_reload_interval_seconds", c.ConfigReloadIntervalSeconds == 0) {
+		c.ConfigReloadIntervalSeconds = DefaultConfigReloadIntervalSeconds
+	}
+	if c.unset("shutdown_grace_period_seconds", c.ShutdownGracePeriodSeconds == 0) {
+		c.ShutdownGracePeriodSeconds = DefaultShutdownGracePeriodSeconds
+	}
+	if c.OutputFormat == "" {
+		c.OutputFormat = DefaultOutputFormat
+	}
+	if c.OutputFileMode == "" {
+		c.OutputFileMode = DefaultOutputFileMode
+	}
+	if c.OutputDirectoryMode == "" {
+		c.OutputDirectoryMode = DefaultOutputDirectoryMode
+	}
+	if c.Ansible.Options == nil {
+		c.Ansible.Options = &playbook.AnsiblePlaybookOptions{}
+	}
+	if c.Ansible.ConnectionOptions == nil {
+		c.Ansible.ConnectionOptions = &options.AnsibleConnectionOptions{}
+	}
+	if c.ItemLogs.MaxLines == 0 {
+		c.ItemLogs.MaxLines = DefaultItemLogMaxLines
+	}
+	if c.ItemLogs.MaxBytes == 0 {
+		c.ItemLogs.MaxBytes = DefaultItemLogMaxBytes
+	}
+	if c.unset("cleanup.max_removed_ratio", c.Cleanup.MaxRemovedRatio == 0) {
+		c.Cleanup.MaxRemovedRatio = DefaultCleanupMaxRemovedRatio
+	}
+	if c.unset("cleanup.min_removed_items", c.Cleanup.MinRemovedItems == 0) {
+		c.Cleanup.MinRemovedItems = DefaultCleanupMinRemovedItems
+	}
+	if c.WriteBack.BatchSize == 0 {
+		c.WriteBack.BatchSize = DefaultWriteBackBatchSize
+	}
+	if c.WriteBack.MaxLogBytes == 0 {
+		c.WriteBack.MaxLogBytes = DefaultWriteBackMaxLogBytes
+	}
+	if len(c.WriteBack.ReadLayers) == 0 && c.WriteBack.Layer != "" {
+		c.WriteBack.ReadLayers = []string{c.WriteBack.Layer}
+	}
+	if c.WriteBack.Attributes.LastDeployTime == "" {
+		c.WriteBack.Attributes.LastDeployTime = DefaultLastDeployTimeAttribute
+	}
+	if c.WriteBack.Attributes.Success == "" {
+		c.WriteBack.Attributes.Success = DefaultSuccessAttribute
+	}
+	if c.WriteBack.Attributes.Log == "" {
+		c.WriteBack.Attributes.Log = DefaultLogAttribute
+	}
+	if c.WriteBack.Attributes.VariablesHash == "" {
+		c.WriteBack.Attributes.VariablesHash = DefaultVariablesHashAttribute
+	}
+	if c.Subscription.DebounceSeconds == 0 {
+		c.Subscription.DebounceSeconds = DefaultSubscriptionDebounceSeconds
+	}
+	if c.Subscription.ReconnectDelaySeconds == 0 {
+		c.Subscription.ReconnectDelaySeconds = DefaultSubscriptionReconnectDelaySeconds
+	}
+}
+
+// unset tells whether a field needs its default, i.e. it is zero and no source of its value is recorded
+func (c *Configuration) unset(path string, zero bool) bool {
+	_, ok := c.Sources[path]
+	return zero && !ok
+}
+
+// Validate checks the configuration and returns all problems at once as ValidationErrors, or nil if it is valid
+// the errors carry YAML paths only, ReadConfigFromBytes adds their line numbers
+func (c Configuration) Validate() error {
+	errs := ValidationErrors{}
+	add := func(path string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		add("log_level", "%q is not a valid log level", c.LogLevel)
+	}
+	if c.OmnikeeperBackendUrl == "" {
+		add("omnikeeper_backend_url", "is required")
+	} else if u, err := url.Parse(c.OmnikeeperBackendUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("omnikeeper_backend_url", "%q is not a valid http or https URL", c.OmnikeeperBackendUrl)
+	}
+	if (c.OmnikeeperClientCertFile == "") != (c.OmnikeeperClientKeyFile == "") {
+		add("omnikeeper_client_key_file", "omnikeeper_client_cert_file and omnikeeper_client_key_file must be set together")
+	}
+
+	switch c.Auth.Mode {
+	case AuthModePassword:
+		if c.Username == "" {
+			add("username", "is required for auth mode %s", c.Auth.Mode)
+		}
+		if c.KeycloakClientId == "" {
+			add("keycloak_client_id", "is required for auth mode %s", c.Auth.Mode)
+		}
+	case AuthModeClientCredentials:
+		if c.KeycloakClientId == "" {
+			add("keycloak_client_id", "is required for auth mode %s", c.Auth.Mode)
+		}
+		if c.Auth.ClientSecret == "" && c.Auth.PrivateKeyFile == "" {
+			add("auth.client_secret", "auth.client_secret or auth.private_key_file is required for auth mode %s", c.Auth.Mode)
+		}
+	case AuthModeTokenFile:
+		if c.Auth.TokenFile == "" {
+			add("auth.token_file", "is required for auth mode %s", c.Auth.Mode)
+		}
+	default:
+		add("auth.mode", "unknown auth mode %q, must be one of %s, %s or %s", c.Auth.Mode, AuthModePassword, AuthModeClientCredentials, AuthModeTokenFile)
+	}
+
+	if c.CollectIntervalSeconds <= 0 {
+		add("collect_interval_seconds", "must be greater than 0")
+	}
+	if c.HealthcheckThresholdSeconds < 0 {
+		add("healthcheck_threshold_seconds", "must not be negative")
+	}
+	if c.HealthcheckMaxFailedRatio < 0 || c.HealthcheckMaxFailedRatio > 1 {
+		add("healthcheck_max_failed_ratio", "must be between 0 and 1")
+	}
+	if c.OutputDirectory == "" {
+		add("output_directory", "is required")
+	}
+	if _, err := variables.NewEncoder(c.OutputFormat); err != nil {
+		add("output_format", "%v", err)
+	}
+	if _, err := ParseFileMode(c.OutputFileMode); err != nil {
+		add("output_file_mode", "%v", err)
+	}
+	if _, err := ParseFileMode(c.OutputDirectoryMode); err != nil {
+		add("output_directory_mode", "%v", err)
+	}
+	if c.ShutdownGracePeriodSeconds < 0 {
+		add("shutdown_grace_period_seconds", "must not be negative")
+	}
+	validateListenAddress(c.HTTPListenAddress, "http_listen_address", add)
+
+	if !c.Ansible.Disabled && len(c.Ansible.Playbooks) == 0 {
+		add("ansible.playbooks", "at least one playbook is required unless ansible is disabled")
+	}
+	for i, p := range c.Ansible.Playbooks {
+		if p == "" {
+			add(fmt.Sprintf("ansible.playbooks[%d]", i), "must not be empty")
+		}
+	}
+	for i, p := range c.Ansible.RemovalPlaybooks {
+		if p == "" {
+			add(fmt.Sprintf("ansible.removal_playbooks[%d]", i), "must not be empty")
+		}
+	}
+	if c.Ansible.MaxParallel < 0 {
+		add("ansible.max_parallel", "must not be negative")
+	}
+
+	if c.Retry.BackoffJitter < 0 || c.Retry.BackoffJitter > 1 {
+		add("retry.backoff_jitter", "must be between 0 and 1")
+	}
+	if c.Retry.BackoffBaseSeconds > 0 && c.Retry.BackoffMaxSeconds > 0 && c.Retry.BackoffMaxSeconds < c.Retry.BackoffBaseSeconds {
+		add("retry.backoff_max_seconds", "must not be less than retry.backoff_base_seconds")
+	}
+
+	if c.Subscription.Enabled && len(c.Subscription.Layers) == 0 {
+		add("subscription.layers", "at least one layer is required when subscription is enabled")
+	}
+
+	if c.API.ListenAddress != "" {
+		validateListenAddress(c.API.ListenAddress, "api.listen_address", add)
+		if c.API.Token == "" && c.API.TokenFile == "" {
+			add("api.token", "api.token or api.token_file is required when api.listen_address is set")
+		}
+	}
+
+	if c.WriteBack.Enabled && c.WriteBack.Layer == "" {
+		add("write_back.layer", "is required when write_back is enabled")
+	}
+	if c.WriteBack.BatchSize < 0 {
+		add("write_back.batch_size", "must not be negative")
+	}
+	if c.WriteBack.MaxLogBytes < 0 {
+		add("write_back.max_log_bytes", "must not be negative")
+	}
+
+	if c.ItemLogs.MaxLines < 0 {
+		add("item_logs.max_lines", "must not be negative")
+	}
+	if c.ItemLogs.MaxBytes < 0 {
+		add("item_logs.max_bytes", "must not be negative")
+	}
+
+	if c.Cleanup.MaxRemovedRatio < 0 || c.Cleanup.MaxRemovedRatio > 1 {
+		add("cleanup.max_removed_ratio", "must be between 0 and 1")
+	}
+	if c.Cleanup.MinRemovedItems < 0 {
+		add("cleanup.min_removed_items", "must not be negative")
+	}
+	if c.Cleanup.GracePeriodSeconds < 0 {
+		add("cleanup.grace_period_seconds", "must not be negative")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ParseFileMode parses octal permissions like 0600, other mode bits are not allowed
+func ParseFileMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("%q is not a valid octal permission, e.g. 0600", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// FileModes returns the permissions of the variables files and the output directory, invalid values fall back to the defaults
+func (c Configuration) FileModes() (file os.FileMode, directory os.FileMode) {
+	file, err := ParseFileMode(c.OutputFileMode)
+	if err != nil {
+		file = 0600
+	}
+	directory, err = ParseFileMode(c.OutputDirectoryMode)
+	if err != nil {
+		directory = 0700
+	}
+	return file, directory
+}
+
+// VariablesEncoder returns the encoder of the variables files, an invalid output_format falls back to JSON
+func (c Configuration) VariablesEncoder() variables.Encoder {
+	encoder, err := variables.NewEncoder(c.OutputFormat)
+	if err != nil {
+		encoder, _ = variables.NewEncoder(variables.FormatJSON)
+	}
+	return encoder
+}
+
+func validateListenAddress(address string, path string, add func(path string, format string, args ...interface{})) {
+	if address == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		add(path, "%q is not a valid listen address, e.g. \":9100\"", address)
+	}
+}
+
+// nodeIndex maps the YAML paths of a document to the lines of their keys and back
+type nodeIndex struct {
+	lines map[string]int
+	paths map[int]string
+}
+
+func newNodeIndex(root *yaml.Node) nodeIndex {
+	index := nodeIndex{lines: make(map[string]int), paths: make(map[int]string)}
+	index.add(root, "")
+	return index
+}
+
+func (index nodeIndex) add(node *yaml.Node, path string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			index.add(child, path)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := key.Value
+			if path != "" {
+				keyPath = path + "." + key.Value
+			}
+			index.record(keyPath, key.Line)
+			index.add(value, keyPath)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			index.record(itemPath, child.Line)
+			index.add(child, itemPath)
+		}
+	}
+}
+
+func (index nodeIndex) record(path string, line int) {
+	index.lines[path] = line
+	// NOTE: the outermost path of a line wins, values of a key are on the line of the key
+	if _, ok := index.paths[line]; !ok {
+		index.paths[line] = path
+	}
+}
+
+// line returns the line of path, or of its closest parent for missing fields
+func (index nodeIndex) line(path string) int {
+	for path != "" {
+		if line, ok := index.lines[path]; ok {
+			return line
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			return 0
+		}
+		path = path[:cut]
+	}
+	return 0
+}
+
+// typeErrors converts the errors of a strict decode, like "line 3: field foo not found in type ...", to validation errors
+func (index nodeIndex) typeErrors(err *yaml.TypeError) ValidationErrors {
+	errs := ValidationErrors{}
+	for _, message := range err.Errors {
+		line := 0
+		_, _ = fmt.Sscanf(message, "line %d:", &line)
+		message = strings.TrimPrefix(message, fmt.Sprintf("line %d: ", line))
+		if strings.HasPrefix(message, "field ") && strings.Contains(message, " not found in type ") {
+			message = "unknown field"
+		}
+		errs = append(errs, ValidationError{Path: index.paths[line], Line: line, Message: message})
+	}
+	return errs
+}
+
+func (errs ValidationErrors) sort() {
+	// NOTE: missing fields without line go last
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line == 0 || errs[j].Line == 0 {
+			return errs[j].Line == 0 && errs[i].Line != 0
+		}
+		return errs[i].Line < errs[j].Line
+	})
+}
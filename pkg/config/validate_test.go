@@ -0,0 +1,127 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleConfigIsValid(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromFilename("../../config/sample-config.yml", &cfg)
+	assert.NoError(t, err)
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, AuthModePassword, cfg.Auth.Mode)
+	assert.Equal(t, DefaultHealthcheckStatFile, cfg.HealthcheckStatFile)
+	assert.Equal(t, DefaultShutdownGracePeriodSeconds, cfg.ShutdownGracePeriodSeconds)
+	assert.Equal(t, DefaultItemLogMaxLines, cfg.ItemLogs.MaxLines)
+	assert.Equal(t, DefaultSuccessAttribute, cfg.WriteBack.Attributes.Success)
+	assert.Equal(t, ".json", cfg.VariablesEncoder().Extension())
+	fileMode, dirMode := cfg.FileModes()
+	assert.Equal(t, os.FileMode(0600), fileMode)
+	assert.Equal(t, os.FileMode(0700), dirMode)
+}
+
+func TestConfigExplicitZeroValues(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(inputConfig+`
+shutdown_grace_period_seconds: 0
+healthcheck_max_failed_ratio: 0
+config_reload_interval_seconds: 0
+cleanup:
+  max_removed_ratio: 0
+  min_removed_items: 0
+`), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.ShutdownGracePeriodSeconds)
+	assert.Equal(t, 0.0, cfg.HealthcheckMaxFailedRatio)
+	assert.Equal(t, 0, cfg.ConfigReloadIntervalSeconds)
+	assert.Equal(t, 0.0, cfg.Cleanup.MaxRemovedRatio)
+	assert.Equal(t, 0, cfg.Cleanup.MinRemovedItems)
+
+	// an explicit 0 from the environment is kept as well
+	t.Setenv("OKDA_CONFIG_RELOAD_INTERVAL_SECONDS", "0")
+	cfg = Configuration{}
+	err = ReadConfigFromBytes([]byte(inputConfig+`
+config_reload_interval_seconds: 10
+`), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cfg.ConfigReloadIntervalSeconds)
+	assert.Equal(t, DefaultShutdownGracePeriodSeconds, cfg.ShutdownGracePeriodSeconds)
+	assert.Equal(t, DefaultHealthcheckMaxFailedRatio, cfg.HealthcheckMaxFailedRatio)
+	assert.Equal(t, DefaultCleanupMinRemovedItems, cfg.Cleanup.MinRemovedItems)
+}
+
+func TestParseFileMode(t *testing.T) {
+	mode, err := ParseFileMode("0640")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), mode)
+	_, err = ParseFileMode("0800")
+	assert.Error(t, err)
+	_, err = ParseFileMode("01777")
+	assert.Error(t, err)
+}
+
+func TestConfigDefaultsAnsibleOptions(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(`log_level: Info
+username: u
+keycloak_client_id: c
+omnikeeper_backend_url: "https://omnikeeper.example.com"
+collect_interval_seconds: 60
+output_directory: ./output
+ansible:
+  playbooks:
+    - playbook.yml
+`), &cfg)
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg.Ansible.Options)
+	assert.NotNil(t, cfg.Ansible.ConnectionOptions)
+}
+
+func TestConfigValidationReportsAllErrors(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte(`log_level: Loud
+username: u
+keycloak_client_id: c
+omnikeeper_backend_url: "omnikeeper.example.com"
+collect_interval_seconds: 0
+colect_interval_seconds: 60
+ansible:
+  playbooks:
+    - playbook.yml
+  max_parallel: many
+write_back:
+  enabled: true
+`), &cfg)
+
+	var errs ValidationErrors
+	if assert.True(t, errors.As(err, &errs), err) {
+		assert.Equal(t, ValidationErrors{
+			{Path: "log_level", Line: 1, Message: `"Loud" is not a valid log level`},
+			{Path: "omnikeeper_backend_url", Line: 4, Message: `"omnikeeper.example.com" is not a valid http or https URL`},
+			{Path: "collect_interval_seconds", Line: 5, Message: "must be greater than 0"},
+			{Path: "colect_interval_seconds", Line: 6, Message: "unknown field"},
+			{Path: "ansible.max_parallel", Line: 10, Message: "cannot unmarshal !!str `many` into int"},
+			{Path: "write_back.layer", Line: 11, Message: "is required when write_back is enabled"},
+			{Path: "output_directory", Line: 0, Message: "is required"},
+		}, errs)
+	}
+	assert.Contains(t, err.Error(), "line 6: colect_interval_seconds: unknown field")
+}
+
+func TestConfigSyntaxError(t *testing.T) {
+	cfg := Configuration{}
+	err := ReadConfigFromBytes([]byte("log_level: [Info\n"), &cfg)
+	assert.Error(t, err)
+	var errs ValidationErrors
+	assert.False(t, errors.As(err, &errs))
+}
@@ -0,0 +1,57 @@
+package fsutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteFileAtomic writes content to filename through a temporary file in the same directory, which is synced and then renamed
+// readers see either the old or the new content, never a partially written file, also if the agent crashes during the write
+func WriteFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	// NOTE: hidden temporary files are not picked up by readers that glob for *.json
+	pattern := filepath.Base(filename) + ".tmp*"
+	if !strings.HasPrefix(pattern, ".") {
+		pattern = "." + pattern
+	}
+	tmpFile, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) // no-op after a successful rename
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing temporary file: %w", err)
+	}
+
+	err = os.Rename(tmpFile.Name(), filename)
+	if err != nil {
+		return fmt.Errorf("Error replacing %s: %w", filename, err)
+	}
+	syncDirectory(dir)
+	return nil
+}
+
+// syncDirectory persists the rename of a file in dir
+// NOTE: errors are ignored, some platforms and filesystems do not support syncing directories
+func syncDirectory(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,55 @@
+package fsutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "item.json")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("old"), 0644))
+
+	err := WriteFileAtomic(filename, []byte("new"), 0600)
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestWriteFileAtomicMissingDirectory(t *testing.T) {
+	err := WriteFileAtomic(filepath.Join(t.TempDir(), "missing", "item.json"), []byte("new"), 0600)
+	assert.Error(t, err)
+}
+
+func TestLockDirectory(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDirectory(dir)
+	assert.NoError(t, err)
+
+	_, err = LockDirectory(dir)
+	assert.True(t, errors.Is(err, ErrLocked), err)
+	assert.Contains(t, err.Error(), "PID")
+
+	assert.NoError(t, lock.Unlock())
+	lock, err = LockDirectory(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Unlock())
+}
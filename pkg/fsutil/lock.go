@@ -0,0 +1,64 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockFilename is the name of the lock file inside a locked directory
+const LockFilename = ".okda.lock"
+
+// ErrLocked is returned by LockDirectory if the directory is locked by another agent
+var ErrLocked = errors.New("directory is locked")
+
+// DirectoryLock is an exclusive lock on a directory, held until Unlock is called or the process exits, also after a crash
+type DirectoryLock struct {
+	file *os.File
+}
+
+// LockDirectory takes the exclusive lock of dir without waiting, the lock file contains the PID of the holder for diagnostics
+func LockDirectory(dir string) (*DirectoryLock, error) {
+	filename := filepath.Join(dir, LockFilename)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening lock file: %w", err)
+	}
+
+	err = lockFile(file)
+	if errors.Is(err, ErrLocked) {
+		_ = file.Close()
+		holder := "unknown"
+		if content, readErr := ioutil.ReadFile(filename); readErr == nil && len(content) > 0 {
+			holder = strings.TrimSpace(string(content))
+		}
+		return nil, fmt.Errorf("Error locking %s, it is used by another agent with PID %s: %w", dir, holder, err)
+	} else if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("Error locking %s: %w", dir, err)
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = unlockFile(file)
+		_ = file.Close()
+		return nil, fmt.Errorf("Error writing lock file: %w", err)
+	}
+	return &DirectoryLock{file: file}, nil
+}
+
+// Unlock releases the lock, the lock file is kept, as removing it could race with another agent taking the lock
+func (l *DirectoryLock) Unlock() error {
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,18 +1,152 @@
 package healthcheck
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
 )
 
-var (
-	statFilename = "/tmp/healthcheck_stat"
+const (
+	DefaultStatFilename = config.DefaultHealthcheckStatFile
 )
 
+// CycleReport describes the outcome of a single cycle
+type CycleReport struct {
+	Started             time.Time `json:"started"`
+	Finished            time.Time `json:"finished"`
+	OmnikeeperReachable bool      `json:"omnikeeper_reachable"`
+	Error               string    `json:"error,omitempty"`
+	ItemsFetched        int       `json:"items_fetched"`
+	ItemsUpdated        int       `json:"items_updated"`
+	ItemsSucceeded      int       `json:"items_succeeded"`
+	ItemsFailed         int       `json:"items_failed"` // includes items that were not run because of backoff or quarantine
+	Successful          bool      `json:"successful"`   // no errors and all updated items were run successfully
+}
+
+// FailedRatio returns the ratio of failed items to all fetched items
+func (r CycleReport) FailedRatio() float64 {
+	if r.ItemsFetched == 0 {
+		return 0
+	}
+	return float64(r.ItemsFailed) / float64(r.ItemsFetched)
+}
+
+// Status is the JSON body of the health endpoints
+type Status struct {
+	Status    string       `json:"status"` // ok or failing
+	Reason    string       `json:"reason,omitempty"`
+	LastTick  time.Time    `json:"last_tick"`
+	LastCycle *CycleReport `json:"last_cycle,omitempty"`
+}
+
+// Tracker collects the liveness and readiness information of the agent and serves it on /healthz and /readyz
+type Tracker struct {
+	livenessThreshold time.Duration
+	maxFailedRatio    float64
+	statFilename      string
+
+	mutex     sync.RWMutex
+	lastTick  time.Time
+	lastCycle *CycleReport
+}
+
+func NewTracker(cfg config.Configuration) *Tracker {
+	statFilename := cfg.HealthcheckStatFile
+	if statFilename == "" {
+		statFilename = DefaultStatFilename
+	}
+	return &Tracker{
+		livenessThreshold: time.Duration(cfg.HealthcheckThresholdSeconds) * time.Second,
+		maxFailedRatio:    cfg.HealthcheckMaxFailedRatio, // NOTE: the default is filled in by config.SetDefaults, 0 fails on any failed item
+		statFilename:      statFilename,
+		lastTick:          time.Now(),
+	}
+}
+
+// Tick signals that the agent loop is making progress
+func (t *Tracker) Tick() {
+	t.mutex.Lock()
+	t.lastTick = time.Now()
+	t.mutex.Unlock()
+}
+
+// CycleFinished records the report of a finished cycle, the stat file is touched for successful cycles
+func (t *Tracker) CycleFinished(report CycleReport) error {
+	t.mutex.Lock()
+	t.lastTick = time.Now()
+	t.lastCycle = &report
+	t.mutex.Unlock()
+
+	if report.Successful {
+		return t.TouchStatFile()
+	}
+	return nil
+}
+
+// TouchStatFile updates the modification time of the stat file that is used by Check when no HTTP listener is configured
+func (t *Tracker) TouchStatFile() error {
+	return touchFile(t.statFilename)
+}
+
+func (t *Tracker) Liveness() (Status, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	status := Status{Status: "ok", LastTick: t.lastTick, LastCycle: t.lastCycle}
+	if t.livenessThreshold > 0 && time.Since(t.lastTick) > t.livenessThreshold {
+		status.Status = "failing"
+		status.Reason = fmt.Sprintf("no progress since %v", t.lastTick)
+		return status, false
+	}
+	return status, true
+}
+
+func (t *Tracker) Readiness() (Status, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	status := Status{Status: "failing", LastTick: t.lastTick, LastCycle: t.lastCycle}
+	switch {
+	case t.lastCycle == nil:
+		status.Reason = "no cycle finished yet"
+	case !t.lastCycle.OmnikeeperReachable:
+		status.Reason = "omnikeeper was not reachable in the last cycle"
+	case t.lastCycle.FailedRatio() > t.maxFailedRatio:
+		status.Reason = fmt.Sprintf("%d of %d items failed in the last cycle", t.lastCycle.ItemsFailed, t.lastCycle.ItemsFetched)
+	default:
+		status.Status = "ok"
+		return status, true
+	}
+	return status, false
+}
+
+func (t *Tracker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, t.Liveness)
+	})
+}
+
+func (t *Tracker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, t.Readiness)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, check func() (Status, bool)) {
+	status, ok := check()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// Check is meant to be run as CLI healthcheck, it exits with 0 if the agent is alive and 1 otherwise
+// if http_listen_address is configured, the agent's /healthz endpoint is queried, otherwise the age of the stat file is checked
 func Check(configFile string) {
 	var cfg = config.Configuration{}
 	err := config.ReadConfigFromFilename(configFile, &cfg)
@@ -21,39 +155,69 @@ func Check(configFile string) {
 		os.Exit(1)
 	}
 
-	file, err := os.Stat(statFilename)
+	if cfg.HTTPListenAddress != "" {
+		err = checkEndpoint(cfg.HTTPListenAddress)
+	} else {
+		err = checkStatFile(cfg)
+	}
 	if err != nil {
-		fmt.Printf("Error reading stats file: %s\n", err)
+		fmt.Println(err)
 		os.Exit(1)
 	}
+	os.Exit(0)
+}
+
+func checkEndpoint(listenAddress string) error {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return fmt.Errorf("Error parsing http_listen_address: %w", err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host, port)))
+	if err != nil {
+		return fmt.Errorf("Error querying health endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var status Status
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("agent is not healthy: %s", status.Reason)
+	}
+	return nil
+}
+
+func checkStatFile(cfg config.Configuration) error {
+	statFilename := cfg.HealthcheckStatFile
+	if statFilename == "" {
+		statFilename = DefaultStatFilename
+	}
+	file, err := os.Stat(statFilename)
+	if err != nil {
+		return fmt.Errorf("Error reading stats file: %w", err)
+	}
 	modifiedtime := file.ModTime()
 
 	isTooOld := time.Now().Sub(modifiedtime) > time.Duration(cfg.HealthcheckThresholdSeconds*int64(time.Second))
 	if isTooOld {
-		fmt.Println("stats file too old")
-		os.Exit(1)
-	} else {
-		os.Exit(0)
+		return fmt.Errorf("stats file too old")
 	}
+	return nil
 }
 
-func TouchStatFile() {
-	touchFile(statFilename)
-}
-
-func touchFile(fileName string) {
+func touchFile(fileName string) error {
 	_, err := os.Stat(fileName)
 	if os.IsNotExist(err) {
 		file, err := os.Create(fileName)
 		if err != nil {
-			log.Fatal(err)
-		}
-		defer file.Close()
-	} else {
-		currentTime := time.Now().Local()
-		err = os.Chtimes(fileName, currentTime, currentTime)
-		if err != nil {
-			fmt.Println(err)
+			return err
 		}
+		return file.Close()
 	}
+	currentTime := time.Now().Local()
+	return os.Chtimes(fileName, currentTime, currentTime)
 }
@@ -0,0 +1,67 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	tracker := NewTracker(config.Configuration{
+		HealthcheckThresholdSeconds: 60,
+		HealthcheckStatFile:         filepath.Join(t.TempDir(), "healthcheck_stat"),
+		HealthcheckMaxFailedRatio:   0.2,
+	})
+
+	get := func(handler http.Handler) (int, Status) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		var status Status
+		err := json.NewDecoder(rec.Body).Decode(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+
+	code, _ := get(tracker.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	code, status := get(tracker.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "no cycle finished yet", status.Reason)
+
+	err := tracker.CycleFinished(CycleReport{Finished: time.Now(), OmnikeeperReachable: false, Error: "connection refused"})
+	assert.NoError(t, err)
+	code, _ = get(tracker.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	err = tracker.CycleFinished(CycleReport{OmnikeeperReachable: true, ItemsFetched: 10, ItemsFailed: 3})
+	assert.NoError(t, err)
+	code, status = get(tracker.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "3 of 10 items failed in the last cycle", status.Reason)
+
+	err = tracker.CycleFinished(CycleReport{OmnikeeperReachable: true, ItemsFetched: 10, ItemsFailed: 1, ItemsSucceeded: 9})
+	assert.NoError(t, err)
+	code, status = get(tracker.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 9, status.LastCycle.ItemsSucceeded)
+}
+
+func TestLivenessFailsWithoutProgress(t *testing.T) {
+	tracker := NewTracker(config.Configuration{HealthcheckThresholdSeconds: 60})
+	tracker.lastTick = time.Now().Add(-2 * time.Minute)
+
+	_, ok := tracker.Liveness()
+	assert.False(t, ok)
+
+	tracker.Tick()
+	_, ok = tracker.Liveness()
+	assert.True(t, ok)
+}
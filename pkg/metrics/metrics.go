@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "okda"
+
+// item statuses used as label values
+const (
+	ItemsFetched   = "fetched"
+	ItemsUpdated   = "updated"
+	ItemsSucceeded = "succeeded"
+	ItemsFailed    = "failed"
+)
+
+// playbook results used as label values
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultTimeout = "timeout"
+)
+
+var durationBuckets = []float64{0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// Metrics holds all collectors of an agent, registered in their own registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	CycleDuration                prometheus.Histogram
+	LastCycleItems               *prometheus.GaugeVec
+	ItemsTotal                   *prometheus.CounterVec
+	PlaybookDuration             *prometheus.HistogramVec
+	OmnikeeperQueryDuration      prometheus.Histogram
+	OmnikeeperErrors             prometheus.Counter
+	VariableFileWriteErrors      prometheus.Counter
+	WriteBackErrors              prometheus.Counter
+	ConfigReloads                *prometheus.CounterVec
+	LastSuccessfulCycleTimestamp prometheus.Gauge
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		CycleDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cycle_duration_seconds",
+			Help:      "Duration of a full fetch/write/ansible/post-process cycle.",
+			Buckets:   durationBuckets,
+		}),
+		LastCycleItems: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_cycle_items",
+			Help:      "Number of items in the last cycle by status.",
+		}, []string{"status"}),
+		ItemsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "items_total",
+			Help:      "Number of items over all cycles by status.",
+		}, []string{"status"}),
+		PlaybookDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "playbook_duration_seconds",
+			Help:      "Duration of the playbook run of a single item by result.",
+			Buckets:   durationBuckets,
+		}, []string{"result"}),
+		OmnikeeperQueryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "omnikeeper_query_duration_seconds",
+			Help:      "Duration of fetching and processing the items from omnikeeper.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		OmnikeeperErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "omnikeeper_errors_total",
+			Help:      "Number of failed attempts to connect to or fetch items from omnikeeper.",
+		}),
+		VariableFileWriteErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "variable_file_write_errors_total",
+			Help:      "Number of variable files that could not be marshalled or written.",
+		}),
+		WriteBackErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "write_back_errors_total",
+			Help:      "Number of items whose result could not be written back to omnikeeper.",
+		}),
+		ConfigReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_reloads_total",
+			Help:      "Number of reloads of the config file by result.",
+		}, []string{"result"}),
+		LastSuccessfulCycleTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_successful_cycle_timestamp_seconds",
+			Help:      "Unix timestamp of the end of the last cycle without errors.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.CycleDuration,
+		m.LastCycleItems,
+		m.ItemsTotal,
+		m.PlaybookDuration,
+		m.OmnikeeperQueryDuration,
+		m.OmnikeeperErrors,
+		m.VariableFileWriteErrors,
+		m.WriteBackErrors,
+		m.ConfigReloads,
+		m.LastSuccessfulCycleTimestamp,
+	)
+	return m
+}
+
+// ObserveCycleItems records the number of items per status of a finished cycle
+func (m *Metrics) ObserveCycleItems(fetched int, updated int, succeeded int, failed int) {
+	for status, count := range map[string]int{
+		ItemsFetched:   fetched,
+		ItemsUpdated:   updated,
+		ItemsSucceeded: succeeded,
+		ItemsFailed:    failed,
+	} {
+		m.LastCycleItems.WithLabelValues(status).Set(float64(count))
+		m.ItemsTotal.WithLabelValues(status).Add(float64(count))
+	}
+}
+
+// Handler serves the metrics in the prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveCycleItems(t *testing.T) {
+	m := New()
+	m.ObserveCycleItems(3, 3, 2, 1)
+	m.ObserveCycleItems(3, 1, 1, 0)
+
+	// the gauges show the last cycle, the counters sum up all cycles
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.LastCycleItems.WithLabelValues(ItemsSucceeded)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.LastCycleItems.WithLabelValues(ItemsFailed)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.ItemsTotal.WithLabelValues(ItemsSucceeded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.ItemsTotal.WithLabelValues(ItemsFailed)))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `okda_items_total{status="fetched"} 6`)
+}
@@ -0,0 +1,222 @@
+package omnikeeper
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/jws"
+)
+
+const jwtBearerClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// buildTokenSource creates the token source for the configured auth mode, ctx carries the HTTP client for token requests
+func buildTokenSource(ctx context.Context, httpClient *http.Client, cfg config.Configuration) (oauth2.TokenSource, error) {
+	switch cfg.Auth.Mode {
+	case "", config.AuthModePassword:
+		oAuthEndpoint, err := fetchOAuthInfo(httpClient, cfg.OmnikeeperBackendUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching oauth info: %w", err)
+		}
+		return oauth2.ReuseTokenSource(nil, &passwordTokenSource{
+			ctx: ctx,
+			config: &oauth2.Config{
+				ClientID: cfg.KeycloakClientId,
+				Endpoint: *oAuthEndpoint,
+				Scopes:   cfg.Auth.Scopes,
+			},
+			username: cfg.Username,
+			password: cfg.Password,
+		}), nil
+	case config.AuthModeClientCredentials:
+		oAuthEndpoint, err := fetchOAuthInfo(httpClient, cfg.OmnikeeperBackendUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching oauth info: %w", err)
+		}
+		if cfg.Auth.PrivateKeyFile != "" {
+			key, err := readRSAPrivateKey(cfg.Auth.PrivateKeyFile)
+			if err != nil {
+				return nil, &SetupError{Err: err}
+			}
+			return oauth2.ReuseTokenSource(nil, &privateKeyJWTTokenSource{
+				ctx:      ctx,
+				clientID: cfg.KeycloakClientId,
+				tokenURL: oAuthEndpoint.TokenURL,
+				scopes:   cfg.Auth.Scopes,
+				key:      key,
+				keyID:    cfg.Auth.PrivateKeyID,
+			}), nil
+		}
+		ccConfig := &clientcredentials.Config{
+			ClientID:     cfg.KeycloakClientId,
+			ClientSecret: cfg.Auth.ClientSecret,
+			TokenURL:     oAuthEndpoint.TokenURL,
+			Scopes:       cfg.Auth.Scopes,
+		}
+		// NOTE: this token source already reuses tokens until they expire
+		return ccConfig.TokenSource(ctx), nil
+	case config.AuthModeTokenFile:
+		if cfg.Auth.TokenFile == "" {
+			return nil, &SetupError{Err: fmt.Errorf("auth mode %s requires auth.token_file", config.AuthModeTokenFile)}
+		}
+		return &fileTokenSource{filename: cfg.Auth.TokenFile}, nil
+	default:
+		return nil, &SetupError{Err: fmt.Errorf("Unknown auth mode %s", cfg.Auth.Mode)}
+	}
+}
+
+// passwordTokenSource refreshes the token using its refresh token and falls back to a new password grant if there is none or refreshing fails
+type passwordTokenSource struct {
+	ctx      context.Context
+	config   *oauth2.Config
+	username string
+	password string
+
+	mutex sync.Mutex
+	token *oauth2.Token
+}
+
+func (s *passwordTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != nil && s.token.RefreshToken != "" {
+		// NOTE: a token without access token is never valid, so this forces a refresh
+		token, err := s.config.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.token.RefreshToken}).Token()
+		if err == nil {
+			s.token = token
+			return token, nil
+		}
+	}
+
+	token, err := s.config.PasswordCredentialsToken(s.ctx, s.username, s.password)
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+
+// privateKeyJWTTokenSource does a client credentials grant, authenticating the client with a signed JWT (private_key_jwt, RFC 7523)
+type privateKeyJWTTokenSource struct {
+	ctx      context.Context
+	clientID string
+	tokenURL string
+	scopes   []string
+	key      *rsa.PrivateKey
+	keyID    string
+}
+
+func (s *privateKeyJWTTokenSource) Token() (*oauth2.Token, error) {
+	assertion, err := s.clientAssertion(time.Now())
+	if err != nil {
+		return nil, &SetupError{Err: fmt.Errorf("Error signing client assertion: %w", err)}
+	}
+	ccConfig := &clientcredentials.Config{
+		ClientID: s.clientID,
+		TokenURL: s.tokenURL,
+		Scopes:   s.scopes,
+		EndpointParams: url.Values{
+			"client_assertion_type": {jwtBearerClientAssertionType},
+			"client_assertion":      {assertion},
+		},
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+	return ccConfig.Token(s.ctx)
+}
+
+func (s *privateKeyJWTTokenSource) clientAssertion(now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+	header := &jws.Header{
+		Algorithm: "RS256",
+		Typ:       "JWT",
+		KeyID:     s.keyID,
+	}
+	claims := &jws.ClaimSet{
+		Iss: s.clientID,
+		Sub: s.clientID,
+		Aud: s.tokenURL,
+		Iat: now.Unix(),
+		Exp: now.Add(time.Minute).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"jti": hex.EncodeToString(jti),
+		},
+	}
+	return jws.Encode(header, claims, s.key)
+}
+
+func readRSAPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading private key file: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in private key file %s", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing private key file %s: %w", filename, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key in file %s is not an RSA key", filename)
+	}
+	return key, nil
+}
+
+// fileTokenSource reads a pre-issued bearer token from a file, e.g. written by a sidecar
+// the file is read again whenever its modification time changes
+type fileTokenSource struct {
+	filename string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	token   *oauth2.Token
+}
+
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		return nil, &SetupError{Err: fmt.Errorf("Error reading token file: %w", err)}
+	}
+	if s.token != nil && info.ModTime().Equal(s.modTime) {
+		return s.token, nil
+	}
+
+	content, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return nil, &SetupError{Err: fmt.Errorf("Error reading token file: %w", err)}
+	}
+	accessToken := strings.TrimSpace(string(content))
+	if accessToken == "" {
+		return nil, &SetupError{Err: fmt.Errorf("Token file %s is empty", s.filename)}
+	}
+	s.token = &oauth2.Token{AccessToken: accessToken, TokenType: "Bearer"}
+	s.modTime = info.ModTime()
+	return s.token, nil
+}
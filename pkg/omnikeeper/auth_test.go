@@ -0,0 +1,81 @@
+package omnikeeper
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/jws"
+)
+
+func TestPrivateKeyJWTTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "token_type": "bearer", "expires_in": 300})
+	}))
+	defer server.Close()
+
+	ts := &privateKeyJWTTokenSource{
+		ctx:      context.Background(),
+		clientID: "agent",
+		tokenURL: server.URL,
+		key:      key,
+	}
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+
+	assert.Equal(t, []string{"client_credentials"}, form["grant_type"])
+	assert.Equal(t, []string{"agent"}, form["client_id"])
+	assert.Equal(t, []string{jwtBearerClientAssertionType}, form["client_assertion_type"])
+	assertion := form["client_assertion"][0]
+	assert.NoError(t, jws.Verify(assertion, &key.PublicKey))
+	claims, err := jws.Decode(assertion)
+	assert.NoError(t, err)
+	assert.Equal(t, "agent", claims.Iss)
+	assert.Equal(t, "agent", claims.Sub)
+	assert.Equal(t, server.URL, claims.Aud)
+}
+
+func TestFileTokenSourceRereadsChangedFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "token")
+	err := ioutil.WriteFile(filename, []byte("first\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &fileTokenSource{filename: filename}
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", token.AccessToken)
+
+	err = ioutil.WriteFile(filename, []byte("second"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	err = os.Chtimes(filename, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", token.AccessToken)
+}
@@ -2,47 +2,85 @@ package omnikeeper
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
 	"golang.org/x/oauth2"
 )
 
+// SetupError is an error of building a client that occurs without contacting omnikeeper or its OAuth server, e.g. an unreadable CA, key or token file
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// BuildGraphQLClient creates a client that authenticates with the resource owner password grant, see BuildGraphQLClientFromConfig
 func BuildGraphQLClient(ctx context.Context, omnikeeperURL string, keycloakClientID string, username string, password string, insecureSkipVerify bool) (*graphql.Client, error) {
+	return BuildGraphQLClientFromConfig(ctx, config.Configuration{
+		OmnikeeperBackendUrl:         omnikeeperURL,
+		OmnikeeperInsecureSkipVerify: insecureSkipVerify,
+		KeycloakClientId:             keycloakClientID,
+		Username:                     username,
+		Password:                     password,
+		Auth:                         config.AuthConfig{Mode: config.AuthModePassword},
+	})
+}
 
-	oAuthEndpoint, err := fetchOAuthInfo(omnikeeperURL, insecureSkipVerify)
+// BuildGraphQLClientFromConfig creates a client that is meant to be reused across cycles, authenticating with the mode configured in the auth section
+// the openid-configuration is only fetched once and tokens are reused until they expire
+// ctx is used for all token requests and must outlive the client
+func BuildGraphQLClientFromConfig(ctx context.Context, cfg config.Configuration) (*graphql.Client, error) {
+	httpClient, err := BuildHTTPClientFromConfig(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("Error fetching oauth info: %w", err)
+		return nil, err
 	}
+	return NewGraphQLClient(cfg, httpClient), nil
+}
+
+// NewGraphQLClient creates a client for the GraphQL endpoint of omnikeeper that sends its requests with httpClient, see BuildHTTPClientFromConfig
+func NewGraphQLClient(cfg config.Configuration, httpClient *http.Client) *graphql.Client {
+	return graphql.NewClient(buildGraphQLURL(cfg), httpClient)
+}
 
-	oauth2cfg := &oauth2.Config{
-		ClientID: keycloakClientID,
-		Endpoint: *oAuthEndpoint,
+// BuildHTTPClientFromConfig creates an HTTP client that adds a bearer token to every request
+// it is meant to be shared by the GraphQL client and the subscription, so tokens are only requested when they expire
+// local problems like unreadable files are returned as *SetupError, failed requests to omnikeeper or its OAuth server are not
+func BuildHTTPClientFromConfig(ctx context.Context, cfg config.Configuration) (*http.Client, error) {
+	// NOTE: the same TLS settings apply to the discovery, token and GraphQL requests
+	baseHttpClient, err := buildHTTPClient(cfg)
+	if err != nil {
+		return nil, &SetupError{Err: err}
 	}
+	modifiedCtx := context.WithValue(ctx, oauth2.HTTPClient, baseHttpClient)
 
-	token, err := oauth2cfg.PasswordCredentialsToken(ctx, username, password)
+	tokenSource, err := buildTokenSource(modifiedCtx, baseHttpClient, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: get a token up front, so that authentication problems show up when building the client
+	_, err = tokenSource.Token()
 	if err != nil {
 		return nil, fmt.Errorf("Error getting token: %w", err)
 	}
 
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
-	var baseHttpClient = &http.Client{
-		Timeout:   time.Second * 30,
-		Transport: customTransport,
-	}
-	modifiedCtx := context.WithValue(ctx, oauth2.HTTPClient, baseHttpClient)
-	httpClient := oauth2cfg.Client(modifiedCtx, token)
-	client := graphql.NewClient(fmt.Sprintf("%s/graphql", omnikeeperURL), httpClient)
+	return oauth2.NewClient(modifiedCtx, tokenSource), nil
+}
 
-	return client, nil
+func buildGraphQLURL(cfg config.Configuration) string {
+	return fmt.Sprintf("%s/graphql", cfg.OmnikeeperBackendUrl)
 }
 
-func fetchOAuthInfo(omnikeeperURL string, insecureSkipVerify bool) (*oauth2.Endpoint, error) {
+func fetchOAuthInfo(httpClient *http.Client, omnikeeperURL string) (*oauth2.Endpoint, error) {
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/.well-known/openid-configuration", omnikeeperURL), nil)
 	if err != nil {
@@ -50,12 +88,6 @@ func fetchOAuthInfo(omnikeeperURL string, insecureSkipVerify bool) (*oauth2.Endp
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
-	var httpClient = &http.Client{
-		Timeout:   time.Second * 20,
-		Transport: customTransport,
-	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("Could not fetch openid-configuration from omnikeeper instance at %s: %w", omnikeeperURL, err)
@@ -0,0 +1,70 @@
+package omnikeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type fakeTokenServer struct {
+	mutex          sync.Mutex
+	grants         []string
+	failRefreshing bool
+}
+
+func (f *fakeTokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	grantType := r.PostForm.Get("grant_type")
+
+	f.mutex.Lock()
+	f.grants = append(f.grants, grantType)
+	fail := f.failRefreshing && grantType == "refresh_token"
+	f.mutex.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  fmt.Sprintf("token-%d", len(f.grants)),
+		"token_type":    "bearer",
+		"refresh_token": "refresh",
+		"expires_in":    300,
+	})
+}
+
+func TestPasswordTokenSourceRefreshesAndFallsBack(t *testing.T) {
+	tokenServer := &fakeTokenServer{}
+	server := httptest.NewServer(tokenServer)
+	defer server.Close()
+
+	ts := &passwordTokenSource{
+		ctx:      context.Background(),
+		config:   &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+		username: "user",
+		password: "password",
+	}
+
+	_, err := ts.Token()
+	assert.NoError(t, err)
+	_, err = ts.Token()
+	assert.NoError(t, err)
+
+	tokenServer.mutex.Lock()
+	tokenServer.failRefreshing = true
+	tokenServer.mutex.Unlock()
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-4", token.AccessToken)
+
+	assert.Equal(t, []string{"password", "refresh_token", "refresh_token", "password"}, tokenServer.grants)
+}
@@ -0,0 +1,63 @@
+package omnikeeper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+)
+
+// DefaultSubscriptionQuery is used when subscription.query is not configured
+// it must declare a $layers variable, every message it receives is treated as a change notification
+const DefaultSubscriptionQuery = `subscription($layers: [String]!) { layerDataChanged(layers: $layers) }`
+
+// subscriptionIdleTimeout is the time without any message (including keep-alives) after which the connection is considered lost
+const subscriptionIdleTimeout = 10 * time.Minute
+
+// SubscribeToLayerChanges opens a GraphQL subscription for changes in the given layers over a websocket and calls onChange for every notification
+// the websocket is opened with httpClient, see BuildHTTPClientFromConfig, so reconnects reuse its token
+// it blocks until ctx is done or the subscription fails; callers are expected to reconnect
+func SubscribeToLayerChanges(ctx context.Context, cfg config.Configuration, httpClient *http.Client, query string, layers []string, onChange func()) error {
+	if query == "" {
+		query = DefaultSubscriptionQuery
+	}
+
+	client := graphql.NewSubscriptionClient(buildGraphQLURL(cfg)).
+		WithWebSocketOptions(graphql.WebsocketOptions{HTTPClient: httpClient}).
+		WithTimeout(subscriptionIdleTimeout).
+		WithRetryTimeout(time.Minute).
+		OnError(func(sc *graphql.SubscriptionClient, err error) error {
+			// NOTE: returning the error stops the client, the caller reconnects with a fresh connection
+			return err
+		})
+
+	_, err := client.SubscribeRaw(query, map[string]interface{}{"layers": layers}, func(message []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("Error in subscription: %w", err)
+		}
+		onChange()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error subscribing to layer changes: %w", err)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-subCtx.Done()
+		_ = client.Close()
+	}()
+
+	err = client.Run()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("Subscription closed by omnikeeper")
+}
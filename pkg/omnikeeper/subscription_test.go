@@ -0,0 +1,97 @@
+package omnikeeper
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// fakeSubscriptionServer speaks the graphql-ws protocol and sends two change notifications for every subscription
+func fakeSubscriptionServer(t *testing.T, authorization chan<- string, variables chan<- map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"graphql-ws"}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		for {
+			var msg struct {
+				ID      string                 `json:"id"`
+				Type    string                 `json:"type"`
+				Payload map[string]interface{} `json:"payload"`
+			}
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case "connection_init":
+				_ = wsjson.Write(ctx, conn, map[string]interface{}{"type": "connection_ack"})
+			case "start":
+				variables <- msg.Payload["variables"].(map[string]interface{})
+				for i := 0; i < 2; i++ {
+					_ = wsjson.Write(ctx, conn, map[string]interface{}{
+						"id":      msg.ID,
+						"type":    "data",
+						"payload": map[string]interface{}{"data": map[string]interface{}{"layerDataChanged": true}},
+					})
+				}
+			}
+		}
+	}))
+}
+
+func TestSubscribeToLayerChanges(t *testing.T) {
+	authorization := make(chan string, 1)
+	variables := make(chan map[string]interface{}, 1)
+	server := fakeSubscriptionServer(t, authorization, variables)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := ioutil.WriteFile(tokenFile, []byte("secret-token"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Configuration{
+		OmnikeeperBackendUrl: server.URL,
+		Auth:                 config.AuthConfig{Mode: config.AuthModeTokenFile, TokenFile: tokenFile},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpClient, err := BuildHTTPClientFromConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan struct{}, 10)
+	done := make(chan error)
+	go func() {
+		done <- SubscribeToLayerChanges(ctx, cfg, httpClient, "", []string{"layer-a"}, func() {
+			changes <- struct{}{}
+		})
+	}()
+
+	assert.Equal(t, "Bearer secret-token", <-authorization)
+	assert.Equal(t, map[string]interface{}{"layers": []interface{}{"layer-a"}}, <-variables)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			t.Fatal("did not receive change notification")
+		}
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,69 @@
+package omnikeeper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+)
+
+// buildHTTPClient creates the HTTP client used for all requests to omnikeeper and its OAuth server
+func buildHTTPClient(cfg config.Configuration) (*http.Client, error) {
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   time.Second * 30,
+		Transport: customTransport,
+	}, nil
+}
+
+func buildTLSConfig(cfg config.Configuration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.OmnikeeperInsecureSkipVerify,
+		ServerName:         cfg.OmnikeeperServerName,
+	}
+
+	if cfg.OmnikeeperCAFile != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		caBundle, err := ioutil.ReadFile(cfg.OmnikeeperCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %w", err)
+		}
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("No valid PEM certificates found in CA file %s", cfg.OmnikeeperCAFile)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if cfg.OmnikeeperClientCertFile != "" || cfg.OmnikeeperClientKeyFile != "" {
+		if cfg.OmnikeeperClientCertFile == "" || cfg.OmnikeeperClientKeyFile == "" {
+			return nil, fmt.Errorf("omnikeeper_client_cert_file and omnikeeper_client_key_file must be set together")
+		}
+		// NOTE: load once to report problems early, afterwards the key pair is loaded on every handshake to pick up rotated certificates
+		_, err := tls.LoadX509KeyPair(cfg.OmnikeeperClientCertFile, cfg.OmnikeeperClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %w", err)
+		}
+		certFile, keyFile := cfg.OmnikeeperClientCertFile, cfg.OmnikeeperClientKeyFile
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Error loading client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
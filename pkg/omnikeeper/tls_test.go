@@ -0,0 +1,128 @@
+package omnikeeper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestBuildHTTPClientWithCAAndClientCertificate(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "omnikeeper.internal"},
+		DNSNames:    []string{"omnikeeper.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "agent"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	dir := t.TempDir()
+	writeFile := func(name string, content []byte) string {
+		filename := filepath.Join(dir, name)
+		err := ioutil.WriteFile(filename, content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	serverKeyPair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"token_endpoint": "https://omnikeeper.internal/token"}`))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := config.Configuration{
+		OmnikeeperCAFile:         writeFile("ca.pem", ca.certPEM),
+		OmnikeeperClientCertFile: writeFile("client.pem", clientCert.certPEM),
+		OmnikeeperClientKeyFile:  writeFile("client-key.pem", clientCert.keyPEM),
+		OmnikeeperServerName:     "omnikeeper.internal",
+	}
+	httpClient, err := buildHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := fetchOAuthInfo(httpClient, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://omnikeeper.internal/token", endpoint.TokenURL)
+
+	// without client certificate, the server rejects the connection
+	cfg.OmnikeeperClientCertFile, cfg.OmnikeeperClientKeyFile = "", ""
+	httpClient, err = buildHTTPClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fetchOAuthInfo(httpClient, server.URL)
+	assert.Error(t, err)
+}
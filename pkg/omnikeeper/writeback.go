@@ -0,0 +1,173 @@
+package omnikeeper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+)
+
+// DefaultWriteBackMutation inserts attributes into the write layer, see config.WriteBackConfig
+const DefaultWriteBackMutation = `mutation($writeLayer: String!, $readLayers: [String]!, $insertAttributes: [InsertCIAttributeInputType]) {
+	mutateCIs(writeLayer: $writeLayer, readLayers: $readLayers, insertAttributes: $insertAttributes) { __typename }
+}`
+
+const (
+	defaultWriteBackBatchSize   = config.DefaultWriteBackBatchSize
+	defaultWriteBackMaxLogBytes = config.DefaultWriteBackMaxLogBytes
+)
+
+// default attribute names, see config.WriteBackAttributes
+const (
+	DefaultLastDeployTimeAttribute = config.DefaultLastDeployTimeAttribute
+	DefaultSuccessAttribute        = config.DefaultSuccessAttribute
+	DefaultLogAttribute            = config.DefaultLogAttribute
+	DefaultVariablesHashAttribute  = config.DefaultVariablesHashAttribute
+)
+
+// DeploymentResult is the outcome of the playbook run of a single CI
+type DeploymentResult struct {
+	Time          time.Time
+	Success       bool
+	Logs          []string
+	VariablesHash string // hash of the variables that were applied
+}
+
+// WriteBack writes deployment results as attributes of their CIs into a layer
+type WriteBack struct {
+	client     *graphql.Client
+	cfg        config.WriteBackConfig
+	attributes config.WriteBackAttributes
+}
+
+func NewWriteBack(client *graphql.Client, cfg config.WriteBackConfig) *WriteBack {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultWriteBackBatchSize
+	}
+	if cfg.MaxLogBytes <= 0 {
+		cfg.MaxLogBytes = defaultWriteBackMaxLogBytes
+	}
+	if len(cfg.ReadLayers) == 0 {
+		cfg.ReadLayers = []string{cfg.Layer}
+	}
+	if cfg.Mutation == "" {
+		cfg.Mutation = DefaultWriteBackMutation
+	}
+	return &WriteBack{
+		client: client,
+		cfg:    cfg,
+		attributes: config.WriteBackAttributes{
+			LastDeployTime: defaultString(cfg.Attributes.LastDeployTime, DefaultLastDeployTimeAttribute),
+			Success:        defaultString(cfg.Attributes.Success, DefaultSuccessAttribute),
+			Log:            defaultString(cfg.Attributes.Log, DefaultLogAttribute),
+			VariablesHash:  defaultString(cfg.Attributes.VariablesHash, DefaultVariablesHashAttribute),
+		},
+	}
+}
+
+// Write writes the results, keyed by CI ID, in batches and returns the write-back errors per CI ID
+// a failed batch is retried CI by CI, so that a single invalid CI does not fail the other CIs of its batch
+func (w *WriteBack) Write(ctx context.Context, results map[string]DeploymentResult) map[string]error {
+	ciids := make([]string, 0, len(results))
+	for ciid := range results {
+		ciids = append(ciids, ciid)
+	}
+	sort.Strings(ciids)
+
+	errs := make(map[string]error)
+	for start := 0; start < len(ciids); start += w.cfg.BatchSize {
+		end := start + w.cfg.BatchSize
+		if end > len(ciids) {
+			end = len(ciids)
+		}
+		batch := ciids[start:end]
+
+		err := w.mutate(ctx, batch, results)
+		if err == nil {
+			continue
+		}
+		if len(batch) == 1 || ctx.Err() != nil {
+			for _, ciid := range batch {
+				errs[ciid] = err
+			}
+			continue
+		}
+		for _, ciid := range batch {
+			err := w.mutate(ctx, []string{ciid}, results)
+			if err != nil {
+				errs[ciid] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (w *WriteBack) mutate(ctx context.Context, ciids []string, results map[string]DeploymentResult) error {
+	insertAttributes := make([]map[string]interface{}, 0, len(ciids)*4)
+	for _, ciid := range ciids {
+		result := results[ciid]
+		insertAttributes = append(insertAttributes,
+			attributeInput(ciid, w.attributes.LastDeployTime, "TEXT", result.Time.UTC().Format(time.RFC3339)),
+			attributeInput(ciid, w.attributes.Success, "BOOLEAN", fmt.Sprintf("%t", result.Success)),
+			attributeInput(ciid, w.attributes.Log, "MULTILINE_TEXT", truncateLog(result.Logs, w.cfg.MaxLogBytes)),
+			attributeInput(ciid, w.attributes.VariablesHash, "TEXT", result.VariablesHash),
+		)
+	}
+
+	_, err := w.client.ExecRaw(ctx, w.cfg.Mutation, map[string]interface{}{
+		"writeLayer":       w.cfg.Layer,
+		"readLayers":       w.cfg.ReadLayers,
+		"insertAttributes": insertAttributes,
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing back results to layer %s: %w", w.cfg.Layer, err)
+	}
+	return nil
+}
+
+func attributeInput(ciid string, name string, valueType string, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"ci":   ciid,
+		"name": name,
+		"value": map[string]interface{}{
+			"type":    valueType,
+			"isArray": false,
+			"values":  []string{value},
+		},
+	}
+}
+
+// truncateLog joins the log lines and drops the beginning if the log is longer than maxBytes, as the end of a log is usually more relevant
+func truncateLog(logs []string, maxBytes int) string {
+	log := strings.Join(logs, "\n")
+	if len(log) <= maxBytes {
+		return log
+	}
+	// NOTE: the marker is sized for the largest possible number of truncated bytes
+	markerLength := len(truncationMarker(len(log)))
+	start := len(log) - maxBytes + markerLength
+	if start > len(log) {
+		start = len(log)
+	}
+	// NOTE: do not cut in the middle of a multi-byte character
+	for start < len(log) && !utf8.RuneStart(log[start]) {
+		start++
+	}
+	return truncationMarker(start) + log[start:]
+}
+
+func truncationMarker(truncatedBytes int) string {
+	return fmt.Sprintf("[... %d bytes truncated ...]\n", truncatedBytes)
+}
+
+func defaultString(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
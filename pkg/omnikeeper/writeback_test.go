@@ -0,0 +1,122 @@
+package omnikeeper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type insertAttribute struct {
+	CI    string `json:"ci"`
+	Name  string `json:"name"`
+	Value struct {
+		Type    string   `json:"type"`
+		IsArray bool     `json:"isArray"`
+		Values  []string `json:"values"`
+	} `json:"value"`
+}
+
+// fakeGraphQLServer records all insertAttributes of mutateCIs calls and rejects every mutation that contains the CI "invalid"
+type fakeGraphQLServer struct {
+	mutex   sync.Mutex
+	batches [][]insertAttribute
+}
+
+func (f *fakeGraphQLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Variables struct {
+			WriteLayer       string            `json:"writeLayer"`
+			ReadLayers       []string          `json:"readLayers"`
+			InsertAttributes []insertAttribute `json:"insertAttributes"`
+		} `json:"variables"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	f.mutex.Lock()
+	f.batches = append(f.batches, req.Variables.InsertAttributes)
+	f.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	for _, attribute := range req.Variables.InsertAttributes {
+		if attribute.CI == "invalid" {
+			_, _ = w.Write([]byte(`{"errors": [{"message": "CI invalid does not exist"}]}`))
+			return
+		}
+	}
+	_, _ = w.Write([]byte(`{"data": {"mutateCIs": {"__typename": "MutateReturnType"}}}`))
+}
+
+func TestWriteBack(t *testing.T) {
+	fake := &fakeGraphQLServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	writeBack := NewWriteBack(graphql.NewClient(server.URL, server.Client()), config.WriteBackConfig{
+		Layer:      "deployments",
+		BatchSize:  2,
+		Attributes: config.WriteBackAttributes{Success: "deploy.ok"},
+	})
+	deployTime := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	errs := writeBack.Write(context.Background(), map[string]DeploymentResult{
+		"ci-a":    {Time: deployTime, Success: true, Logs: []string{"line 1", "line 2"}, VariablesHash: "hash-a"},
+		"ci-b":    {Time: deployTime, Success: false, VariablesHash: "hash-b"},
+		"invalid": {Time: deployTime, Success: true},
+	})
+
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs["invalid"].Error(), "CI invalid does not exist")
+	}
+
+	// first batch with ci-a and ci-b, second batch with the invalid CI
+	assert.Len(t, fake.batches, 2)
+	assert.Len(t, fake.batches[0], 8)
+	attributes := make(map[string]insertAttribute)
+	for _, attribute := range fake.batches[0] {
+		attributes[attribute.CI+" "+attribute.Name] = attribute
+	}
+	assert.Equal(t, []string{"2022-05-01T12:00:00Z"}, attributes["ci-a okda.last_deploy_time"].Value.Values)
+	assert.Equal(t, []string{"true"}, attributes["ci-a deploy.ok"].Value.Values)
+	assert.Equal(t, "BOOLEAN", attributes["ci-a deploy.ok"].Value.Type)
+	assert.Equal(t, []string{"line 1\nline 2"}, attributes["ci-a okda.log"].Value.Values)
+	assert.Equal(t, []string{"hash-a"}, attributes["ci-a okda.variables_hash"].Value.Values)
+	assert.Equal(t, []string{"false"}, attributes["ci-b deploy.ok"].Value.Values)
+}
+
+func TestWriteBackRetriesFailedBatchPerCI(t *testing.T) {
+	fake := &fakeGraphQLServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	writeBack := NewWriteBack(graphql.NewClient(server.URL, server.Client()), config.WriteBackConfig{Layer: "deployments"})
+	errs := writeBack.Write(context.Background(), map[string]DeploymentResult{
+		"ci-a":    {Success: true},
+		"invalid": {Success: true},
+		"ci-c":    {Success: true},
+	})
+
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs, "invalid")
+	// the failed batch and one mutation per CI
+	assert.Len(t, fake.batches, 4)
+}
+
+func TestTruncateLog(t *testing.T) {
+	assert.Equal(t, "a\nb", truncateLog([]string{"a", "b"}, 100))
+
+	logs := []string{strings.Repeat("x", 100), strings.Repeat("ü", 50), "end"}
+	truncated := truncateLog(logs, 64)
+	assert.LessOrEqual(t, len(truncated), 64)
+	assert.True(t, strings.HasPrefix(truncated, "[... "))
+	assert.True(t, strings.HasSuffix(truncated, "ü\nend"))
+	assert.True(t, utf8.ValidString(truncated))
+}
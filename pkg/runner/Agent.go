@@ -0,0 +1,241 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/fsutil"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/metrics"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/omnikeeper"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent drives the deployments of a single configuration, it holds all state of the agent, so several agents can run in one process
+// agents running concurrently need their own logger, output directory, healthcheck stat file and listen addresses
+type Agent struct {
+	processor  Processor
+	configFile string
+	configHash string               // hash of the content of the config file at startup or the last reload
+	cfg        config.Configuration // replaced on reload, only between cycles
+	log        *logrus.Logger
+
+	store        *state.Store          // opened on the first cycle, see open
+	mutex        sync.RWMutex          // guards cfg, store and the omnikeeper clients, which are also used by the API and the subscription while cycles run
+	lock         *fsutil.DirectoryLock // held from the first cycle until Close if output_directory_lock is set
+	okClient     *graphql.Client
+	okHTTPClient *http.Client // shared by okClient and the subscription, see connection
+	metrics      *metrics.Metrics
+	health       *healthcheck.Tracker
+	trigger      *cycleTrigger
+}
+
+// NewAgent loads the configuration and applies its log level to log, the output directory is not touched until the agent is run
+func NewAgent(processor Processor, configFile string, log *logrus.Logger) (*Agent, error) {
+	log.Infof("Loading config from file: %s", configFile)
+	cfg, configHash, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if configurable, ok := processor.(ConfigurableProcessor); ok {
+		err = configurable.Configure(configFile, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring processor: %w", err)
+		}
+	}
+	setLogLevel(log, cfg)
+	log.WithFields(configLogFields(cfg)).Infof("Loaded config from file %s", configFile)
+
+	addItemLogHook(log)
+
+	return &Agent{
+		processor:  processor,
+		configFile: configFile,
+		configHash: configHash,
+		cfg:        cfg,
+		log:        log,
+		metrics:    metrics.New(),
+		health:     healthcheck.NewTracker(cfg),
+		trigger:    newCycleTrigger(),
+	}, nil
+}
+
+// Run runs cycles in the collect interval and whenever they are triggered, until ctx is done
+// in-flight playbook runs get the shutdown grace period to finish after ctx is done, the agent is closed on return
+func (a *Agent) Run(ctx context.Context) error {
+	defer a.Close()
+	err := a.open()
+	if err != nil {
+		return err
+	}
+
+	if a.cfg.HTTPListenAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", a.metrics.Handler())
+		mux.Handle("/healthz", a.health.LivenessHandler())
+		mux.Handle("/readyz", a.health.ReadinessHandler())
+		serveHTTP(ctx, a.cfg.HTTPListenAddress, mux, a.log)
+	}
+
+	if a.cfg.API.ListenAddress != "" {
+		token, err := apiToken(a.cfg.API)
+		if err != nil {
+			return fmt.Errorf("Error configuring API: %w", err)
+		}
+		serveHTTP(ctx, a.cfg.API.ListenAddress, newAPIHandler(token, a.trigger, a.apiItems, a.log), a.log)
+	}
+
+	if a.cfg.Subscription.Enabled {
+		go watchSubscription(ctx, a.cfg.Subscription, a.connection, a.trigger, a.log)
+	}
+
+	reloads := make(chan config.Configuration, 1)
+	go watchConfigFile(ctx, a.configFile, a.configHash, configReloadInterval(a.cfg), reloads, a.metrics, a.log)
+
+	ticker := time.NewTicker(time.Duration(a.cfg.CollectIntervalSeconds * int(time.Second)))
+	defer ticker.Stop()
+	// NOTE: the health tracker is also ticked while waiting for the next cycle, so /healthz only fails if the agent hangs, even with a threshold below the collect interval
+	var livenessTicks <-chan time.Time
+	if a.cfg.HealthcheckThresholdSeconds > 0 {
+		livenessTicker := time.NewTicker(time.Duration(a.cfg.HealthcheckThresholdSeconds) * time.Second / 2)
+		defer livenessTicker.Stop()
+		livenessTicks = livenessTicker.C
+	}
+	runCycle := true
+	for {
+		if runCycle {
+			a.runOnce(ctx, a.trigger.TakeForced())
+		}
+
+		collectInterval := a.cfg.CollectIntervalSeconds
+		select {
+		case <-ctx.Done():
+			a.log.Infof("Received shutdown signal, stopping")
+			return nil
+		case <-ticker.C:
+			runCycle = true
+		case <-a.trigger.C():
+			runCycle = true
+		case <-livenessTicks:
+			a.health.Tick()
+			runCycle = false
+			continue
+		case cfg := <-reloads:
+			// NOTE: reloads are applied between cycles only, so a cycle always sees a single config
+			a.reloadConfig(cfg)
+			runCycle = false
+			if a.cfg.CollectIntervalSeconds == collectInterval {
+				continue
+			}
+		}
+		ticker.Reset(time.Duration(a.cfg.CollectIntervalSeconds * int(time.Second)))
+	}
+}
+
+// RunOnce runs a single cycle and returns its summary, the output directory stays locked until Close is called
+func (a *Agent) RunOnce(ctx context.Context) CycleSummary {
+	err := a.open()
+	if err != nil {
+		a.log.Errorf("%v", err)
+		return CycleSummary{
+			CycleReport: healthcheck.CycleReport{Error: err.Error()},
+			NotStarted:  true,
+			Items:       make(map[string]ItemSummary),
+		}
+	}
+	return a.runOnce(ctx, nil)
+}
+
+// apiItems returns the state store and the retry settings of the current config for the API, the store is nil while the agent is closed
+func (a *Agent) apiItems() (*state.Store, config.RetryConfig) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.store, a.cfg.Retry
+}
+
+// open locks the output directory if configured, loads the state store and touches the healthcheck stat file
+// it is a no-op once the store is loaded
+func (a *Agent) open() error {
+	if a.store != nil {
+		return nil
+	}
+	fileMode, dirMode := a.cfg.FileModes()
+	if a.cfg.OutputDirectoryLock {
+		err := os.MkdirAll(a.cfg.OutputDirectory, dirMode)
+		if err != nil {
+			return fmt.Errorf("Error creating output directory: %w", err)
+		}
+		lock, err := fsutil.LockDirectory(a.cfg.OutputDirectory)
+		if err != nil {
+			return fmt.Errorf("Error locking output directory: %w", err)
+		}
+		a.lock = lock
+	}
+	store, err := openStateStore(a.cfg.OutputDirectory, dirMode, a.log)
+	if err != nil {
+		a.Close()
+		return fmt.Errorf("Error opening state store: %w", err)
+	}
+	a.mutex.Lock()
+	a.store = store
+	a.mutex.Unlock()
+	restrictPermissions(a.cfg.OutputDirectory, store, fileMode, dirMode, a.log)
+
+	// NOTE: touch stats file at the beginning
+	err = a.health.TouchStatFile()
+	if err != nil {
+		a.log.Errorf("Error touching healthcheck stat file: %v", err)
+	}
+	return nil
+}
+
+// Close releases the lock of the output directory, the state store is loaded again on the next run
+func (a *Agent) Close() {
+	a.mutex.Lock()
+	a.store = nil
+	a.mutex.Unlock()
+	if a.lock == nil {
+		return
+	}
+	err := a.lock.Unlock()
+	if err != nil {
+		a.log.Errorf("Error unlocking output directory: %v", err)
+	}
+	a.lock = nil
+}
+
+// client returns the omnikeeper GraphQL client, it is built once and reused in later cycles, it refreshes its token by itself
+func (a *Agent) client() (*graphql.Client, error) {
+	_, httpClient, err := a.connection()
+	if err != nil {
+		return nil, err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.okClient == nil {
+		a.okClient = omnikeeper.NewGraphQLClient(a.cfg, httpClient)
+	}
+	return a.okClient, nil
+}
+
+// connection returns the current config with the authenticated HTTP client for omnikeeper, which is shared by the GraphQL client and the subscription
+// the HTTP client is built once and only rebuilt after a reload changed the connection settings, see omnikeeperConnectionChanged
+func (a *Agent) connection() (config.Configuration, *http.Client, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.okHTTPClient == nil {
+		httpClient, err := omnikeeper.BuildHTTPClientFromConfig(context.Background(), a.cfg)
+		if err != nil {
+			return a.cfg, nil, err
+		}
+		a.okHTTPClient = httpClient
+	}
+	return a.cfg, a.okHTTPClient, nil
+}
@@ -0,0 +1,162 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/fsutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticProcessor struct {
+	items map[string]interface{}
+	err   error // returned by Process instead of the items if set
+
+	mutex   sync.Mutex
+	results map[string]ProcessResultItem
+}
+
+func (p *staticProcessor) Process(configFile string, ctx context.Context, okClient *graphql.Client, log *logrus.Logger) (map[string]interface{}, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.items, nil
+}
+
+func (p *staticProcessor) PostProcess(configFile string, ctx context.Context, okClient *graphql.Client, log *logrus.Logger, results map[string]ProcessResultItem) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.results = results
+	return nil
+}
+
+// writeAgentConfig writes the config of an agent with disabled ansible and its own output directory to dir
+func writeAgentConfig(t *testing.T, dir string, logLevel string) string {
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("token"), 0600))
+	configFile := filepath.Join(dir, "config.yml")
+	content := fmt.Sprintf(`log_level: %s
+omnikeeper_backend_url: "http://localhost:1"
+auth:
+  mode: token_file
+  token_file: %s
+collect_interval_seconds: 10
+healthcheck_stat_file: %s
+output_directory: %s
+ansible:
+  disabled: true
+  playbooks:
+    - playbook.yml
+  connection_options:
+    user: user
+  options:
+    inventory: localhost,
+`, logLevel, tokenFile, filepath.Join(dir, "healthcheck_stat"), filepath.Join(dir, "output"))
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(content), 0600))
+	return configFile
+}
+
+// newTestAgent returns an agent of processor with the config of writeAgentConfig in a temporary directory, which is returned as well
+// the agent's log is discarded, the agent is closed when the test ends
+func newTestAgent(t *testing.T, processor Processor) (*Agent, string) {
+	dir := t.TempDir()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	agent, err := NewAgent(processor, writeAgentConfig(t, dir, "info"), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(agent.Close)
+	return agent, dir
+}
+
+func TestAgentsRunConcurrently(t *testing.T) {
+	processors := []*staticProcessor{
+		{items: map[string]interface{}{"a1": map[string]string{"name": "a1"}, "shared": map[string]string{"name": "from a"}}},
+		{items: map[string]interface{}{"b1": map[string]string{"name": "b1"}, "shared": map[string]string{"name": "from b"}}},
+	}
+	dirs := []string{t.TempDir(), t.TempDir()}
+	agents := make([]*Agent, len(processors))
+	for i, processor := range processors {
+		log := logrus.New()
+		log.Out = ioutil.Discard
+		agent, err := NewAgent(processor, writeAgentConfig(t, dirs[i], []string{"info", "debug"}[i]), log)
+		assert.NoError(t, err)
+		agents[i] = agent
+	}
+	assert.Equal(t, logrus.InfoLevel, agents[0].log.GetLevel())
+	assert.Equal(t, logrus.DebugLevel, agents[1].log.GetLevel())
+
+	summaries := make([]CycleSummary, len(agents))
+	var wg sync.WaitGroup
+	for i, agent := range agents {
+		i, agent := i, agent
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summaries[i] = agent.RunOnce(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	for i, summary := range summaries {
+		assert.Equal(t, ExitCodeOK, summary.ExitCode())
+		assert.Len(t, summary.Items, 2)
+		assert.Len(t, processors[i].results, 2)
+	}
+	assert.Contains(t, summaries[0].Items, "a1")
+	assert.Contains(t, summaries[1].Items, "b1")
+
+	// every agent writes to its own output directory and keeps its own state
+	shared, err := ioutil.ReadFile(filepath.Join(dirs[1], "output", "shared.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(shared), "from b")
+	_, ok := agents[0].store.Get("b1")
+	assert.False(t, ok)
+	_, ok = agents[1].store.Get("b1")
+	assert.True(t, ok)
+}
+
+func TestAgentOutputDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeAgentConfig(t, dir, "info")
+	content, err := ioutil.ReadFile(configFile)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(configFile, append(content, []byte("output_directory_lock: true\n")...), 0600))
+
+	agents := make([]*Agent, 2)
+	for i := range agents {
+		log := logrus.New()
+		log.Out = ioutil.Discard
+		agents[i], err = NewAgent(&staticProcessor{items: map[string]interface{}{"a1": map[string]string{"name": "a1"}}}, configFile, log)
+		assert.NoError(t, err)
+	}
+
+	summary := agents[0].RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	summary = agents[1].RunOnce(context.Background())
+	assert.Contains(t, summary.Error, "used by another agent")
+	assert.Equal(t, ExitCodeError, summary.ExitCode())
+
+	// the lock survives the cleanup of old files, variables files and the directory are private by default
+	outputDirectory := filepath.Join(dir, "output")
+	assert.FileExists(t, filepath.Join(outputDirectory, fsutil.LockFilename))
+	dirInfo, err := os.Stat(outputDirectory)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), dirInfo.Mode().Perm())
+	fileInfo, err := os.Stat(filepath.Join(outputDirectory, "a1.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+	agents[0].Close()
+	summary = agents[1].RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	agents[1].Close()
+}
@@ -2,18 +2,48 @@ package runner
 
 import (
 	"context"
+	"time"
 
 	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/ansible"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
 	"github.com/sirupsen/logrus"
 )
 
+type ItemStatus string
+
+const (
+	ItemStatusSucceeded     ItemStatus = "succeeded"
+	ItemStatusFailed        ItemStatus = "failed"
+	ItemStatusBackoff       ItemStatus = "backoff"        // not run, the item failed before and waits for its next retry
+	ItemStatusQuarantined   ItemStatus = "quarantined"    // not run, the item failed too often and is not retried until its data changes
+	ItemStatusRemoved       ItemStatus = "removed"        // the item is not returned by the processor anymore, its removal playbooks were run and its files were deleted
+	ItemStatusRemovalFailed ItemStatus = "removal_failed" // the removal playbooks failed or the files could not be deleted, the removal is retried like a failed deployment
+)
+
 type ProcessResultItem struct {
-	Success  bool
-	Logs     []string
-	BaseData interface{}
+	Success        bool
+	Status         ItemStatus
+	TimedOut       bool  // the playbook run was killed because it exceeded ansible.item_timeout_seconds
+	Error          error // first error of a failed item, wraps ansible.ErrTimeout for timed out runs
+	FailureCount   int   // consecutive failures of the item
+	NextAttempt    time.Time
+	Finished       time.Time // end of the last playbook run of the item
+	VariablesHash  string    // hash of the variables of the last playbook run of the item
+	Logs           []string
+	AnsibleResult  *ansible.Result // per-host and per-task results of the playbook run, nil if the playbook was not run or its output could not be parsed
+	BaseData       interface{}     // the item as returned by the processor, nil for removed items
+	WriteBackError error           // set if write_back is enabled and the result could not be written to omnikeeper
 }
 
 type Processor interface {
 	Process(configFile string, ctx context.Context, okClient *graphql.Client, log *logrus.Logger) (map[string]interface{}, error)
 	PostProcess(configFile string, ctx context.Context, okClient *graphql.Client, log *logrus.Logger, results map[string]ProcessResultItem) error
 }
+
+// ConfigurableProcessor is implemented by processors that need the parsed configuration
+// Configure is called when the agent is created and after every reload of the config file, never during a cycle
+// if it returns an error, the reloaded config is rejected and the processor must keep its last good config
+type ConfigurableProcessor interface {
+	Configure(configFile string, cfg config.Configuration) error
+}
@@ -0,0 +1,41 @@
+package runner
+
+import (
+	"sync"
+)
+
+// WorkerPool runs queued jobs on a fixed number of worker goroutines
+type WorkerPool struct {
+	queue chan func()
+	wg    sync.WaitGroup
+}
+
+func NewWorkerPool(workers int, queueSize int) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		queue: make(chan func(), queueSize),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.queue {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// Submit enqueues a job, blocking while the queue is full
+func (p *WorkerPool) Submit(job func()) {
+	p.queue <- job
+}
+
+// Wait closes the queue and blocks until all submitted jobs have finished; the pool can not be reused afterwards
+func (p *WorkerPool) Wait() {
+	close(p.queue)
+	p.wg.Wait()
+}
@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolLimitsConcurrency(t *testing.T) {
+	pool := NewWorkerPool(3, 20)
+
+	// the first 3 tasks wait for each other, so they are guaranteed to overlap
+	var running, maxRunning, started, finished int32
+	var mutex sync.Mutex
+	barrier := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		pool.Submit(func() {
+			current := atomic.AddInt32(&running, 1)
+			mutex.Lock()
+			if current > maxRunning {
+				maxRunning = current
+			}
+			mutex.Unlock()
+			switch n := atomic.AddInt32(&started, 1); {
+			case n < 3:
+				select {
+				case <-barrier:
+				case <-time.After(5 * time.Second):
+				}
+			case n == 3:
+				close(barrier)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&finished, 1)
+		})
+	}
+	pool.Wait()
+
+	assert.Equal(t, int32(20), finished)
+	assert.Equal(t, int32(3), maxRunning)
+}
@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+)
+
+// apiItem is the representation of an item in GET /items
+type apiItem struct {
+	ID         string     `json:"id"`
+	Status     ItemStatus `json:"status"`
+	RunPending bool       `json:"run_pending"` // the item is forced to run in the next cycle
+	state.ItemState
+}
+
+// apiToken returns the bearer token that is required by the API
+func apiToken(cfg config.APIConfig) (string, error) {
+	token := cfg.Token
+	if cfg.TokenFile != "" {
+		content, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Error reading API token file: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		return "", fmt.Errorf("api.token or api.token_file is required when api.listen_address is set")
+	}
+	return token, nil
+}
+
+// newAPIHandler serves POST /run (start a full cycle), POST /items/{id}/run (force the item to run, even if its data is unchanged) and GET /items (list all items with their state)
+// cycles are requested through the trigger, so they are run by the main loop and never overlap
+// itemSource is called on every request, so reloaded configs are taken into account
+func newAPIHandler(token string, trigger *cycleTrigger, itemSource func() (*state.Store, config.RetryConfig), log *logrus.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		log.Infof("Cycle requested via API")
+		trigger.Trigger()
+		writeAPIResponse(w, http.StatusAccepted, map[string]string{"status": "scheduled"})
+	})
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		store, retryCfg := itemSource()
+		if store == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "agent is not running")
+			return
+		}
+		now := time.Now()
+		items := make([]apiItem, 0)
+		for _, id := range store.IDs() {
+			itemState, ok := store.Get(id)
+			if !ok {
+				continue
+			}
+			items = append(items, apiItem{
+				ID:         id,
+				Status:     itemStatusFromState(itemState, now, retryCfg.QuarantineAfterFailures),
+				RunPending: trigger.IsForced(id),
+				ItemState:  itemState,
+			})
+		}
+		writeAPIResponse(w, http.StatusOK, items)
+	})
+	mux.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/items/")
+		if !strings.HasSuffix(path, "/run") || strings.Count(path, "/") != 1 {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		id := strings.TrimSuffix(path, "/run")
+		store, _ := itemSource()
+		if store == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "agent is not running")
+			return
+		}
+		// NOTE: items are only known once a cycle wrote them, new items are picked up by any cycle anyway
+		if _, ok := store.Get(id); !ok {
+			writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown item %s", id))
+			return
+		}
+		log.Infof("Run of item %s requested via API", id)
+		trigger.Force(id)
+		writeAPIResponse(w, http.StatusAccepted, map[string]string{"status": "scheduled", "id": id})
+	})
+	return requireBearerToken(token, mux)
+}
+
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// itemStatusFromState returns the status of an item as of its last run
+func itemStatusFromState(item state.ItemState, now time.Time, quarantineAfter int) ItemStatus {
+	switch {
+	case item.FailureCount == 0:
+		return ItemStatusSucceeded
+	case quarantineAfter > 0 && item.FailureCount >= quarantineAfter:
+		return ItemStatusQuarantined
+	case now.Before(item.NextAttempt):
+		return ItemStatusBackoff
+	default:
+		return ItemStatusFailed
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, statusCode int, message string) {
+	writeAPIResponse(w, statusCode, map[string]string{"error": message})
+}
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPI(t *testing.T) (http.Handler, *cycleTrigger, *state.Store) {
+	handler, trigger, store, _ := newTestAPIWithRetry(t)
+	return handler, trigger, store
+}
+
+// newTestAPIWithRetry returns the API handler with retry settings that can be changed while it is used, like on reload
+func newTestAPIWithRetry(t *testing.T) (http.Handler, *cycleTrigger, *state.Store, *config.RetryConfig) {
+	store, err := state.Load(filepath.Join(t.TempDir(), state.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.RecordSuccess("item-ok", "hash-a", now)
+	store.RecordFailure("item-failed", "hash-b", errors.New("playbook failed"), now, func(int) time.Duration { return time.Hour })
+
+	trigger := newCycleTrigger()
+	retryCfg := &config.RetryConfig{}
+	itemSource := func() (*state.Store, config.RetryConfig) {
+		return store, *retryCfg
+	}
+	return newAPIHandler("secret", trigger, itemSource, logrus.New()), trigger, store, retryCfg
+}
+
+func apiRequest(handler http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func triggered(trigger *cycleTrigger) bool {
+	select {
+	case <-trigger.C():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	handler, trigger, _ := newTestAPI(t)
+
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(handler, http.MethodPost, "/run", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, apiRequest(handler, http.MethodPost, "/run", "wrong").Code)
+	assert.False(t, triggered(trigger))
+}
+
+func TestAPIRun(t *testing.T) {
+	handler, trigger, _ := newTestAPI(t)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, apiRequest(handler, http.MethodGet, "/run", "secret").Code)
+	assert.False(t, triggered(trigger))
+
+	assert.Equal(t, http.StatusAccepted, apiRequest(handler, http.MethodPost, "/run", "secret").Code)
+	assert.True(t, triggered(trigger))
+	assert.Empty(t, trigger.TakeForced())
+}
+
+func TestAPIRunItem(t *testing.T) {
+	handler, trigger, _ := newTestAPI(t)
+
+	assert.Equal(t, http.StatusNotFound, apiRequest(handler, http.MethodPost, "/items/unknown/run", "secret").Code)
+	assert.False(t, triggered(trigger))
+
+	assert.Equal(t, http.StatusAccepted, apiRequest(handler, http.MethodPost, "/items/item-ok/run", "secret").Code)
+	assert.True(t, triggered(trigger))
+	assert.Equal(t, map[string]bool{"item-ok": true}, trigger.TakeForced())
+	assert.Empty(t, trigger.TakeForced())
+}
+
+func TestAPIListItems(t *testing.T) {
+	handler, trigger, _ := newTestAPI(t)
+	trigger.Force("item-failed")
+
+	rec := apiRequest(handler, http.MethodGet, "/items", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var items []apiItem
+	err := json.Unmarshal(rec.Body.Bytes(), &items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, items, 2)
+	assert.Equal(t, "item-failed", items[0].ID)
+	assert.Equal(t, ItemStatusBackoff, items[0].Status)
+	assert.True(t, items[0].RunPending)
+	assert.Equal(t, "playbook failed", items[0].LastError)
+	assert.Equal(t, "item-ok", items[1].ID)
+	assert.Equal(t, ItemStatusSucceeded, items[1].Status)
+	assert.False(t, items[1].RunPending)
+	assert.Equal(t, "hash-a", items[1].ContentHash)
+}
+
+func TestAPIListItemsAfterReload(t *testing.T) {
+	handler, _, _, retryCfg := newTestAPIWithRetry(t)
+
+	status := func() ItemStatus {
+		var items []apiItem
+		err := json.Unmarshal(apiRequest(handler, http.MethodGet, "/items", "secret").Body.Bytes(), &items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items[0].Status
+	}
+	assert.Equal(t, ItemStatusBackoff, status())
+	retryCfg.QuarantineAfterFailures = 1
+	assert.Equal(t, ItemStatusQuarantined, status())
+}
+
+func TestAPIOfClosedAgent(t *testing.T) {
+	handler := newAPIHandler("secret", newCycleTrigger(), func() (*state.Store, config.RetryConfig) {
+		return nil, config.RetryConfig{}
+	}, logrus.New())
+	assert.Equal(t, http.StatusServiceUnavailable, apiRequest(handler, http.MethodGet, "/items", "secret").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, apiRequest(handler, http.MethodPost, "/items/a/run", "secret").Code)
+}
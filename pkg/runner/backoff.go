@@ -0,0 +1,28 @@
+package runner
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+)
+
+// retryDelay returns the exponential backoff delay after the given number of consecutive failures
+func retryDelay(cfg config.RetryConfig, failureCount int) time.Duration {
+	if cfg.BackoffBaseSeconds <= 0 || failureCount <= 0 {
+		return 0
+	}
+
+	delay := float64(cfg.BackoffBaseSeconds) * math.Pow(2, float64(failureCount-1))
+	if cfg.BackoffMaxSeconds > 0 && delay > float64(cfg.BackoffMaxSeconds) {
+		delay = float64(cfg.BackoffMaxSeconds)
+	}
+	if cfg.BackoffJitter > 0 {
+		delay = delay * (1 + cfg.BackoffJitter*(2*rand.Float64()-1))
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay * float64(time.Second))
+}
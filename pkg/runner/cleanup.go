@@ -0,0 +1,161 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/ansible"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+)
+
+// ownedFiles returns the variables files of an item inside the output directory
+// items recorded by older versions have no list of files, they own the JSON variables file that these versions wrote
+func ownedFiles(id string, item state.ItemState) []string {
+	if item.Files == nil {
+		return []string{id + legacyVariablesFileSuffix}
+	}
+	return item.Files
+}
+
+// checkRemovedRatio fails if a larger share of the known items than allowed by cleanup.max_removed_ratio is not returned by the processor
+// items whose removal is still pending are counted as well, so a large drop can't pass in small steps during the grace period
+// forced items are not counted, forcing an item via the API accepts its removal
+func checkRemovedRatio(store *state.Store, outputItems map[string]interface{}, forced map[string]bool, cleanupCfg config.CleanupConfig) error {
+	if cleanupCfg.MaxRemovedRatio >= 1 {
+		return nil
+	}
+	ids := store.IDs()
+	known, removed := len(ids), 0
+	for _, id := range ids {
+		if _, ok := outputItems[id]; !ok && !forced[id] {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	// NOTE: the ratio of small inventories is too coarse, e.g. the removal of the only item would block every later cycle
+	if cleanupCfg.MaxRemovedRatio > 0 && removed < cleanupCfg.MinRemovedItems {
+		return nil
+	}
+	if ratio := float64(removed) / float64(known); ratio > cleanupCfg.MaxRemovedRatio {
+		return fmt.Errorf("Refusing to remove %d of %d items (%.0f%%), cleanup.max_removed_ratio allows %.0f%%; the processor may have returned incomplete data", removed, known, ratio*100, cleanupCfg.MaxRemovedRatio*100)
+	}
+	return nil
+}
+
+// removalContentHash is recorded as content hash of failed removals, so they are retried with backoff, but never mistaken for a failed deployment
+const removalContentHash = "removal"
+
+// dueRemovals marks all items that are not returned by the processor anymore as removed and returns those that are due for removal
+// the files are kept for cleanup.grace_period_seconds, if an item is returned again within this period, its removal is cancelled
+func (a *Agent) dueRemovals(outputItems map[string]interface{}, forced map[string]bool, now time.Time) []string {
+	store, log := a.store, a.log
+	due := make([]string, 0)
+	for _, id := range store.IDs() {
+		if _, ok := outputItems[id]; ok {
+			continue
+		}
+		removedAt := store.MarkRemoved(id, now)
+		dueAt, decision := removalDecision(store, id, removedAt, forced[id], now, a.cfg.Cleanup, a.cfg.Retry)
+		if now.Before(dueAt) {
+			log.Debugf("Item %s is not returned anymore, removing it in %v", id, dueAt.Sub(now).Round(time.Second))
+			continue
+		}
+		switch decision {
+		case state.Backoff:
+			log.Debugf("Not retrying removal of item %s before its next attempt", id)
+			continue
+		case state.Quarantined:
+			log.Debugf("Not retrying removal of item %s because it failed too often", id)
+			continue
+		}
+		due = append(due, id)
+	}
+	return due
+}
+
+// removalDecision returns when the grace period of an item that is not returned since removedAt ends and whether its removal is run from then on
+// items whose removal failed are retried like failed deployments, see config.RetryConfig, forced items are retried right away, even if quarantined
+func removalDecision(store *state.Store, id string, removedAt time.Time, forced bool, now time.Time, cleanupCfg config.CleanupConfig, retryCfg config.RetryConfig) (time.Time, state.Decision) {
+	dueAt := removedAt.Add(time.Duration(cleanupCfg.GracePeriodSeconds) * time.Second)
+	if forced {
+		return dueAt, state.Run
+	}
+	return dueAt, store.Decide(id, removalContentHash, now, retryCfg.QuarantineAfterFailures)
+}
+
+// removeItem runs the removal playbooks of an item with its last variables file and deletes its files and its state
+// files of the output directory that were not written by the agent are never deleted
+// if the playbooks fail or the files can't be deleted, everything is kept and the removal is retried in a later cycle
+func (a *Agent) removeItem(id string, ctx context.Context, itemLog *logrus.Entry) ProcessResultItem {
+	item, _ := a.store.Get(id)
+	files := ownedFiles(id, item)
+	result := ProcessResultItem{
+		Success:       true,
+		Status:        ItemStatusRemoved,
+		VariablesHash: item.ContentHash,
+	}
+
+	var err error
+	if len(a.cfg.Ansible.RemovalPlaybooks) > 0 {
+		removalCfg, variableFile := removalCallout(a.cfg, files)
+		playbookStart := time.Now()
+		result.AnsibleResult, err = ansible.Callout(ctx, removalCfg, id, variableFile, a.cfg.Ansible.Disabled, itemLog)
+		a.metrics.PlaybookDuration.WithLabelValues(playbookResult(err)).Observe(time.Since(playbookStart).Seconds())
+		if err != nil {
+			err = fmt.Errorf("Error running removal playbooks: %w", err)
+		}
+	}
+	if err == nil {
+		err = deleteFiles(a.cfg.OutputDirectory, files)
+	}
+
+	if err != nil {
+		itemLog.Errorf("Error removing item %s: %v", id, err)
+		a.store.RecordFailure(id, removalContentHash, err, time.Now(), func(failureCount int) time.Duration {
+			return retryDelay(a.cfg.Retry, failureCount)
+		})
+		item, _ = a.store.Get(id)
+		result.Success = false
+		result.Status = ItemStatusRemovalFailed
+		result.TimedOut = errors.Is(err, ansible.ErrTimeout)
+		result.Error = err
+		result.FailureCount = item.FailureCount
+		result.NextAttempt = item.NextAttempt
+		result.Finished = item.LastAttempt
+		return result
+	}
+	a.store.Remove(id)
+	result.Finished = time.Now()
+	itemLog.Infof("Removed item %s", id)
+	return result
+}
+
+// removalCallout returns the settings to run the removal playbooks with and the variables file they get, the first of the item's files
+func removalCallout(cfg config.Configuration, files []string) (config.AnsibleCalloutConfig, string) {
+	removalCfg := cfg.Ansible
+	removalCfg.Playbooks = removalCfg.RemovalPlaybooks
+	variableFile := ""
+	if len(files) > 0 {
+		variableFile = filepath.Join(cfg.OutputDirectory, files[0])
+	}
+	return removalCfg, variableFile
+}
+
+// deleteFiles deletes the files inside the output directory, files that do not exist are ignored
+func deleteFiles(outputDirectory string, files []string) error {
+	for _, filename := range files {
+		err := os.Remove(filepath.Join(outputDirectory, filename))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error deleting file %s: %w", filename, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupRemovedItems(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b", "c": "c", "d": "d"}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outputDirectory, "foreign.json"), []byte("{}"), 0600))
+
+	// an empty or incomplete result does not wipe the output directory
+	processor.items = map[string]interface{}{}
+	summary = agent.RunOnce(context.Background())
+	assert.Contains(t, summary.Error, "Refusing to remove 4 of 4 items")
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	// removed items are kept during the grace period and restored if they come back
+	agent.cfg.Cleanup.GracePeriodSeconds = 3600
+	processor.items = map[string]interface{}{"b": "b", "c": "c", "d": "d"}
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+	item, ok := agent.store.Get("a")
+	assert.True(t, ok)
+	assert.False(t, item.RemovedAt.IsZero())
+
+	processor.items = map[string]interface{}{"a": "a", "b": "b", "c": "c", "d": "d"}
+	agent.RunOnce(context.Background())
+	item, _ = agent.store.Get("a")
+	assert.True(t, item.RemovedAt.IsZero())
+
+	// without grace period, files are deleted right away, files that were not written by the agent are kept
+	agent.cfg.Cleanup.GracePeriodSeconds = 0
+	processor.items = map[string]interface{}{"b": "b", "c": "c", "d": "d"}
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.Equal(t, ItemStatusRemoved, summary.Items["a"].Status)
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+	assert.FileExists(t, filepath.Join(outputDirectory, "b.json"))
+	assert.FileExists(t, filepath.Join(outputDirectory, "foreign.json"))
+	_, ok = agent.store.Get("a")
+	assert.False(t, ok)
+}
+
+func TestCleanupMaxRemovedRatio(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b", "c": "c", "d": "d"}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+
+	// with a ratio of 0, not a single item is removed
+	agent.cfg.Cleanup.MaxRemovedRatio = 0
+	processor.items = map[string]interface{}{"b": "b", "c": "c", "d": "d"}
+	summary = agent.RunOnce(context.Background())
+	assert.Contains(t, summary.Error, "Refusing to remove 1 of 4 items")
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+	item, _ := agent.store.Get("a")
+	assert.True(t, item.RemovedAt.IsZero())
+
+	// items whose removal is pending during the grace period still count, so a large drop can't pass in small steps
+	agent.cfg.Cleanup.MaxRemovedRatio = 0.5
+	agent.cfg.Cleanup.GracePeriodSeconds = 3600
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	processor.items = map[string]interface{}{"c": "c", "d": "d"}
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	processor.items = map[string]interface{}{"d": "d"}
+	summary = agent.RunOnce(context.Background())
+	assert.Contains(t, summary.Error, "Refusing to remove 3 of 4 items")
+	item, _ = agent.store.Get("c")
+	assert.True(t, item.RemovedAt.IsZero())
+}
+
+func TestCleanupSmallInventories(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a"}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+
+	// single removals are not refused by the ratio, even if they are the whole inventory
+	agent.RunOnce(context.Background())
+	processor.items = map[string]interface{}{}
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	processor.items = map[string]interface{}{"a": "a", "b": "b"}
+	agent.RunOnce(context.Background())
+	processor.items = map[string]interface{}{"b": "b"}
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	// without a minimum, the ratio also applies to single items, forcing an item accepts its removal
+	agent.cfg.Cleanup.MinRemovedItems = 0
+	processor.items = map[string]interface{}{}
+	summary = agent.RunOnce(context.Background())
+	assert.Contains(t, summary.Error, "Refusing to remove 1 of 1 items")
+	assert.FileExists(t, filepath.Join(outputDirectory, "b.json"))
+	summary = agent.runOnce(context.Background(), map[string]bool{"b": true})
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.Equal(t, ItemStatusRemoved, summary.Items["b"].Status)
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "b.json"))
+}
+
+// useRemovalPlaybook enables ansible with a fake ansible-playbook that records the calls of the removal playbook, which fails while the fail file exists
+func useRemovalPlaybook(t *testing.T, agent *Agent, dir string) (callsFile string, failFile string) {
+	callsFile = filepath.Join(dir, "calls")
+	failFile = filepath.Join(dir, "fail")
+	removalPlaybook := filepath.Join(dir, "removal.yml")
+	assert.NoError(t, ioutil.WriteFile(removalPlaybook, []byte("---\n"), 0600))
+	binary := filepath.Join(dir, "ansible-playbook")
+	script := fmt.Sprintf("#!/bin/sh\ncase \"$*\" in *removal.yml*) echo \"$@\" >> %s; [ -f %s ] && exit 2;; esac\necho '{\"plays\": [], \"stats\": {}}'\n", callsFile, failFile)
+	assert.NoError(t, ioutil.WriteFile(binary, []byte(script), 0700))
+	agent.cfg.Ansible.Disabled = false
+	agent.cfg.Ansible.Playbooks = []string{"../../contrib/sample-playbook.yml"}
+	agent.cfg.Ansible.RemovalPlaybooks = []string{removalPlaybook}
+	agent.cfg.Ansible.AnsibleBinary = binary
+	return callsFile, failFile
+}
+
+func TestRemovalPlaybooks(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b"}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+
+	callsFile, failFile := useRemovalPlaybook(t, agent, dir)
+
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.NoFileExists(t, callsFile)
+
+	// a failed removal keeps the files of the item
+	assert.NoError(t, ioutil.WriteFile(failFile, nil, 0600))
+	processor.items = map[string]interface{}{"b": "b"}
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeItemsFailed, summary.ExitCode())
+	assert.Equal(t, ItemStatusRemovalFailed, summary.Items["a"].Status)
+	assert.Equal(t, ItemStatusRemovalFailed, processor.results["a"].Status)
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	// the removal is retried in the next cycle
+	assert.NoError(t, os.Remove(failFile))
+	summary = agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.Equal(t, ItemStatusRemoved, summary.Items["a"].Status)
+	assert.Equal(t, ItemStatusRemoved, processor.results["a"].Status)
+	assert.True(t, processor.results["a"].Success)
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	calls, err := ioutil.ReadFile(callsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(calls), "\n"), "the removal playbook is run once per attempt")
+	assert.Contains(t, string(calls), filepath.Join(outputDirectory, "a.json"), "the last variables file is passed as host_variable_file")
+
+	// the item is gone, its removal playbook is not run again
+	agent.RunOnce(context.Background())
+	calls, _ = ioutil.ReadFile(callsFile)
+	assert.Equal(t, 2, strings.Count(string(calls), "\n"))
+}
+
+func TestOutputFormatChange(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": map[string]string{"name": "a"}}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+
+	agent.RunOnce(context.Background())
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	// the item is run again with the new variables file, the file of the old format is deleted
+	agent.cfg.OutputFormat = "yaml"
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ItemStatusSucceeded, summary.Items["a"].Status)
+	content, err := ioutil.ReadFile(filepath.Join(outputDirectory, "a.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "name: a\n", string(content))
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+	item, _ := agent.store.Get("a")
+	assert.Equal(t, []string{"a.yml"}, item.Files)
+}
+
+func TestOutputFormatKeepsForeignFiles(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": map[string]string{"name": "a"}}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+	assert.NoError(t, os.MkdirAll(outputDirectory, 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outputDirectory, "a.json"), []byte("{}"), 0600))
+
+	// a.json was not written by the agent, so it is kept when the item is written in another format
+	agent.cfg.OutputFormat = "yaml"
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOK, summary.ExitCode())
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.yml"))
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+}
+
+func TestForcedRemovalOfQuarantinedItem(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b"}}
+	agent, dir := newTestAgent(t, processor)
+	outputDirectory := filepath.Join(dir, "output")
+	callsFile, failFile := useRemovalPlaybook(t, agent, dir)
+	agent.cfg.Retry.QuarantineAfterFailures = 1
+
+	agent.RunOnce(context.Background())
+	assert.NoError(t, ioutil.WriteFile(failFile, nil, 0600))
+	processor.items = map[string]interface{}{"b": "b"}
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ItemStatusRemovalFailed, summary.Items["a"].Status)
+
+	// the quarantined removal is not retried on its own
+	assert.NoError(t, os.Remove(failFile))
+	agent.RunOnce(context.Background())
+	calls, _ := ioutil.ReadFile(callsFile)
+	assert.Equal(t, 1, strings.Count(string(calls), "\n"))
+	assert.FileExists(t, filepath.Join(outputDirectory, "a.json"))
+
+	// forcing the item retries its removal
+	summary = agent.runOnce(context.Background(), map[string]bool{"a": true})
+	assert.Equal(t, ItemStatusRemoved, summary.Items["a"].Status)
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "a.json"))
+	_, ok := agent.store.Get("a")
+	assert.False(t, ok)
+}
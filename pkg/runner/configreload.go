@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// configReloadInterval returns the configured polling interval, the default is filled in by config.SetDefaults, so 0 disables polling
+func configReloadInterval(cfg config.Configuration) time.Duration {
+	if cfg.ConfigReloadIntervalSeconds > 0 {
+		return time.Duration(cfg.ConfigReloadIntervalSeconds) * time.Second
+	}
+	return 0
+}
+
+// watchConfigFile re-reads the config file whenever its content changes and on SIGHUP, until ctx is done
+// valid configs are passed to reloads, replacing a config that was not applied yet; invalid configs are logged and dropped
+// the file is polled in the given interval, an interval of 0 only reloads on SIGHUP
+func watchConfigFile(ctx context.Context, configFile string, configHash string, interval time.Duration, reloads chan config.Configuration, agentMetrics *metrics.Metrics, log *logrus.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Infof("Received SIGHUP, reloading config file %s", configFile)
+			force = true
+		case <-poll:
+		}
+
+		cfg, newHash, err := readConfig(configFile)
+		if !force && newHash == configHash {
+			continue
+		}
+		// NOTE: the hash is also updated for invalid configs, so an invalid config is only reported once
+		configHash = newHash
+		if err != nil {
+			log.Errorf("Error reloading config file %s, keeping the last good config: %v", configFile, err)
+			agentMetrics.ConfigReloads.WithLabelValues(metrics.ResultFailure).Inc()
+			continue
+		}
+
+		select {
+		case <-reloads:
+		default:
+		}
+		reloads <- cfg
+	}
+}
+
+// reloadConfig applies a reloaded config, it must only be called between cycles
+func (a *Agent) reloadConfig(cfg config.Configuration) {
+	ignored := keepStartupSettings(a.cfg, &cfg)
+	if len(ignored) > 0 {
+		a.log.Warnf("Changes of %s in config file %s only take effect after a restart", strings.Join(ignored, ", "), a.configFile)
+	}
+
+	if configurable, ok := a.processor.(ConfigurableProcessor); ok {
+		err := configurable.Configure(a.configFile, cfg)
+		if err != nil {
+			a.log.Errorf("Error reloading config file %s, keeping the last good config: processor rejected config: %v", a.configFile, err)
+			a.metrics.ConfigReloads.WithLabelValues(metrics.ResultFailure).Inc()
+			return
+		}
+	}
+
+	setLogLevel(a.log, cfg)
+	a.mutex.Lock()
+	if omnikeeperConnectionChanged(a.cfg, cfg) {
+		// NOTE: the clients are rebuilt with the new settings in the next cycle or on the next reconnect of the subscription
+		a.okClient = nil
+		a.okHTTPClient = nil
+	}
+	a.cfg = cfg
+	a.mutex.Unlock()
+	a.metrics.ConfigReloads.WithLabelValues(metrics.ResultSuccess).Inc()
+	a.log.WithFields(configLogFields(cfg)).Infof("Reloaded config from file %s", a.configFile)
+}
+
+// keepStartupSettings copies the settings that are only read at startup from old to cfg and returns the names of those that were changed
+func keepStartupSettings(old config.Configuration, cfg *config.Configuration) []string {
+	ignored := make([]string, 0)
+	if cfg.OutputDirectory != old.OutputDirectory {
+		ignored = append(ignored, "output_directory")
+		cfg.OutputDirectory = old.OutputDirectory
+	}
+	// NOTE: the permissions of existing files are only fixed at startup, see restrictPermissions
+	if cfg.OutputFileMode != old.OutputFileMode {
+		ignored = append(ignored, "output_file_mode")
+		cfg.OutputFileMode = old.OutputFileMode
+	}
+	if cfg.OutputDirectoryMode != old.OutputDirectoryMode {
+		ignored = append(ignored, "output_directory_mode")
+		cfg.OutputDirectoryMode = old.OutputDirectoryMode
+	}
+	if cfg.OutputDirectoryLock != old.OutputDirectoryLock {
+		ignored = append(ignored, "output_directory_lock")
+		cfg.OutputDirectoryLock = old.OutputDirectoryLock
+	}
+	if cfg.HTTPListenAddress != old.HTTPListenAddress {
+		ignored = append(ignored, "http_listen_address")
+		cfg.HTTPListenAddress = old.HTTPListenAddress
+	}
+	if cfg.HealthcheckThresholdSeconds != old.HealthcheckThresholdSeconds {
+		ignored = append(ignored, "healthcheck_threshold_seconds")
+		cfg.HealthcheckThresholdSeconds = old.HealthcheckThresholdSeconds
+	}
+	if cfg.HealthcheckStatFile != old.HealthcheckStatFile {
+		ignored = append(ignored, "healthcheck_stat_file")
+		cfg.HealthcheckStatFile = old.HealthcheckStatFile
+	}
+	if cfg.HealthcheckMaxFailedRatio != old.HealthcheckMaxFailedRatio {
+		ignored = append(ignored, "healthcheck_max_failed_ratio")
+		cfg.HealthcheckMaxFailedRatio = old.HealthcheckMaxFailedRatio
+	}
+	if cfg.ConfigReloadIntervalSeconds != old.ConfigReloadIntervalSeconds {
+		ignored = append(ignored, "config_reload_interval_seconds")
+		cfg.ConfigReloadIntervalSeconds = old.ConfigReloadIntervalSeconds
+	}
+	if cfg.API != old.API {
+		ignored = append(ignored, "api")
+		cfg.API = old.API
+	}
+	if !reflect.DeepEqual(cfg.Subscription, old.Subscription) {
+		ignored = append(ignored, "subscription")
+		cfg.Subscription = old.Subscription
+	}
+	return ignored
+}
+
+// omnikeeperConnectionChanged returns whether settings of the omnikeeper GraphQL client differ between the configs
+func omnikeeperConnectionChanged(old config.Configuration, cfg config.Configuration) bool {
+	return old.OmnikeeperBackendUrl != cfg.OmnikeeperBackendUrl ||
+		old.OmnikeeperInsecureSkipVerify != cfg.OmnikeeperInsecureSkipVerify ||
+		old.OmnikeeperCAFile != cfg.OmnikeeperCAFile ||
+		old.OmnikeeperClientCertFile != cfg.OmnikeeperClientCertFile ||
+		old.OmnikeeperClientKeyFile != cfg.OmnikeeperClientKeyFile ||
+		old.OmnikeeperServerName != cfg.OmnikeeperServerName ||
+		old.KeycloakClientId != cfg.KeycloakClientId ||
+		old.Username != cfg.Username ||
+		old.Password != cfg.Password ||
+		!reflect.DeepEqual(old.Auth, cfg.Auth)
+}
+
+// setLogLevel applies the log level of a config that was validated by readConfig
+func setLogLevel(log *logrus.Logger, cfg config.Configuration) {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err == nil {
+		log.SetLevel(level)
+	}
+}
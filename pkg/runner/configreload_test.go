@@ -0,0 +1,114 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchConfigFile(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	configFile := writeAgentConfig(t, t.TempDir(), "info")
+	_, configHash, err := readConfig(configFile)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan config.Configuration, 1)
+	go watchConfigFile(ctx, configFile, configHash, 10*time.Millisecond, reloads, metrics.New(), log)
+
+	content, _ := ioutil.ReadFile(configFile)
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(strings.Replace(string(content), "log_level: info", "log_level: debug", 1)), 0600))
+	select {
+	case cfg := <-reloads:
+		assert.Equal(t, "debug", cfg.LogLevel)
+	case <-time.After(time.Second):
+		assert.Fail(t, "config was not reloaded")
+	}
+
+	// invalid configs are dropped
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(strings.Replace(string(content), "log_level: info", "log_level: loud", 1)), 0600))
+	select {
+	case cfg := <-reloads:
+		assert.Fail(t, "invalid config was reloaded", cfg.LogLevel)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type rejectingProcessor struct {
+	staticProcessor
+	configured []config.Configuration
+}
+
+func (p *rejectingProcessor) Configure(configFile string, cfg config.Configuration) error {
+	if len(cfg.Ansible.Playbooks) == 0 {
+		return errors.New("no playbooks")
+	}
+	p.configured = append(p.configured, cfg)
+	return nil
+}
+
+func TestAgentReloadConfig(t *testing.T) {
+	processor := &rejectingProcessor{}
+	agent, dir := newTestAgent(t, processor)
+	log := agent.log
+	assert.Len(t, processor.configured, 1)
+
+	cfg := agent.cfg
+	cfg.LogLevel = "debug"
+	cfg.CollectIntervalSeconds = 20
+	cfg.OutputDirectory = filepath.Join(dir, "other")
+	cfg.Retry.QuarantineAfterFailures = 3
+	agent.reloadConfig(cfg)
+	assert.Equal(t, logrus.DebugLevel, log.GetLevel())
+	assert.Equal(t, 20, agent.cfg.CollectIntervalSeconds)
+	// the API sees the reloaded retry settings
+	_, retryCfg := agent.apiItems()
+	assert.Equal(t, 3, retryCfg.QuarantineAfterFailures)
+	// the output directory is only read at startup
+	assert.Equal(t, filepath.Join(dir, "output"), agent.cfg.OutputDirectory)
+	assert.Len(t, processor.configured, 2)
+
+	// configs rejected by the processor are not applied
+	cfg = agent.cfg
+	cfg.LogLevel = "warn"
+	cfg.Ansible.Playbooks = nil
+	agent.reloadConfig(cfg)
+	assert.Equal(t, logrus.DebugLevel, log.GetLevel())
+	assert.Equal(t, []string{"playbook.yml"}, agent.cfg.Ansible.Playbooks)
+}
+
+func TestAgentReusesOmnikeeperConnection(t *testing.T) {
+	agent, _ := newTestAgent(t, &staticProcessor{})
+
+	_, first, err := agent.connection()
+	assert.NoError(t, err)
+	_, second, err := agent.connection()
+	assert.NoError(t, err)
+	assert.Same(t, first, second, "reconnects of the subscription reuse the HTTP client and its token")
+
+	// reloads without changes of the connection settings keep the client
+	cfg := agent.cfg
+	cfg.CollectIntervalSeconds = 20
+	agent.reloadConfig(cfg)
+	_, third, _ := agent.connection()
+	assert.Same(t, first, third)
+
+	cfg = agent.cfg
+	cfg.OmnikeeperBackendUrl = "http://localhost:2"
+	agent.reloadConfig(cfg)
+	current, fourth, err := agent.connection()
+	assert.NoError(t, err)
+	assert.NotSame(t, first, fourth)
+	assert.Equal(t, "http://localhost:2", current.OmnikeeperBackendUrl)
+}
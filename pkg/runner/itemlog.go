@@ -0,0 +1,191 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultItemLogMaxLines = config.DefaultItemLogMaxLines
+	defaultItemLogMaxBytes = config.DefaultItemLogMaxBytes
+)
+
+const lineTruncationMarker = " [...]"
+
+type itemLogBufferKey struct{}
+
+// itemLogHook adds every log entry to the itemLogBuffer in the entry's context, see withItemLogBuffer
+// the hook itself is stateless, logs are collected per item and cycle, so overlapping cycles do not mix up their logs
+type itemLogHook struct{}
+
+func (h itemLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h itemLogHook) Fire(e *logrus.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if buffer, ok := e.Context.Value(itemLogBufferKey{}).(*itemLogBuffer); ok {
+		buffer.Add(e.Message)
+	}
+	return nil
+}
+
+// addItemLogHook installs the itemLogHook on the logger, unless it is installed already
+func addItemLogHook(log *logrus.Logger) {
+	for _, hook := range log.Hooks[logrus.InfoLevel] {
+		if _, ok := hook.(itemLogHook); ok {
+			return
+		}
+	}
+	log.AddHook(itemLogHook{})
+}
+
+// withItemLogBuffer returns an entry whose log messages are collected in buffer
+func withItemLogBuffer(entry *logrus.Entry, buffer *itemLogBuffer) *logrus.Entry {
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return entry.WithContext(context.WithValue(ctx, itemLogBufferKey{}, buffer))
+}
+
+// itemLogBuffer collects the log lines of a single item, bounded by a number of lines and bytes
+// when the limits are exceeded, the first and the last lines are kept, separated by a truncation marker
+type itemLogBuffer struct {
+	mutex sync.Mutex
+
+	headMaxLines int
+	headMaxBytes int
+	tailMaxLines int
+	tailMaxBytes int
+
+	head      []string
+	headBytes int
+	tail      []string
+	tailBytes int
+
+	truncatedLines int
+	truncatedBytes int
+}
+
+func newItemLogBuffer(cfg config.ItemLogConfig) *itemLogBuffer {
+	maxLines := cfg.MaxLines
+	if maxLines <= 0 {
+		maxLines = defaultItemLogMaxLines
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultItemLogMaxBytes
+	}
+	return &itemLogBuffer{
+		headMaxLines: maxLines / 2,
+		headMaxBytes: maxBytes / 2,
+		tailMaxLines: maxLines - maxLines/2,
+		tailMaxBytes: maxBytes - maxBytes/2,
+	}
+}
+
+func (b *itemLogBuffer) Add(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(line) > b.tailMaxBytes {
+		line = truncateString(line, b.tailMaxBytes-len(lineTruncationMarker)) + lineTruncationMarker
+	}
+
+	// NOTE: the head is only filled until the first line does not fit anymore, so the order of lines is kept
+	if len(b.tail) == 0 && b.truncatedLines == 0 && len(b.head) < b.headMaxLines && b.headBytes+len(line) <= b.headMaxBytes {
+		b.head = append(b.head, line)
+		b.headBytes += len(line)
+		return
+	}
+
+	b.tail = append(b.tail, line)
+	b.tailBytes += len(line)
+	for len(b.tail) > b.tailMaxLines || b.tailBytes > b.tailMaxBytes {
+		b.truncatedLines++
+		b.truncatedBytes += len(b.tail[0])
+		b.tailBytes -= len(b.tail[0])
+		b.tail = b.tail[1:]
+	}
+}
+
+// Lines returns a copy of the collected lines, including a marker where lines were truncated
+func (b *itemLogBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	lines := make([]string, 0, len(b.head)+len(b.tail)+1)
+	lines = append(lines, b.head...)
+	if b.truncatedLines > 0 {
+		lines = append(lines, fmt.Sprintf("[... %d lines (%d bytes) truncated ...]", b.truncatedLines, b.truncatedBytes))
+	}
+	lines = append(lines, b.tail...)
+	return lines
+}
+
+// truncateString cuts s to at most maxBytes, without splitting multi-byte characters
+func truncateString(s string, maxBytes int) string {
+	if maxBytes <= 0 {
+		return ""
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// LogCollectorHook collects the messages of all log entries with an item field, without any limits
+//
+// Deprecated: the runner collects the logs of every item per cycle and passes them to PostProcess as ProcessResultItem.Logs,
+// the hook is not installed anymore and only kept for applications that install it themselves; it will be removed in the next major version.
+type LogCollectorHook struct {
+	Logs  map[string][]string
+	Mutex sync.RWMutex
+}
+
+// Deprecated: see LogCollectorHook.
+func NewLogCollectorHook() *LogCollectorHook {
+	return &LogCollectorHook{
+		Logs: make(map[string][]string),
+	}
+}
+
+func (h *LogCollectorHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *LogCollectorHook) Fire(e *logrus.Entry) error {
+	itemID, ok := e.Data["item"].(string)
+	if ok && itemID != "" { // only collect item based logs
+		h.Mutex.Lock()
+		h.Logs[itemID] = append(h.Logs[itemID], e.Message)
+		h.Mutex.Unlock()
+	}
+	return nil
+}
+
+func (h *LogCollectorHook) ClearLogs() {
+	h.Mutex.Lock()
+	h.Logs = make(map[string][]string)
+	h.Mutex.Unlock()
+}
+
+// GetLogs returns a copy of the collected logs
+func (h *LogCollectorHook) GetLogs() map[string][]string {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	logs := make(map[string][]string, len(h.Logs))
+	for id, lines := range h.Logs {
+		logs[id] = append([]string(nil), lines...)
+	}
+	return logs
+}
@@ -0,0 +1,94 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemLogBufferKeepsHeadAndTail(t *testing.T) {
+	buffer := newItemLogBuffer(config.ItemLogConfig{MaxLines: 4, MaxBytes: 1000})
+	for i := 1; i <= 10; i++ {
+		buffer.Add(fmt.Sprintf("line %d", i))
+	}
+	assert.Equal(t, []string{"line 1", "line 2", "[... 6 lines (36 bytes) truncated ...]", "line 9", "line 10"}, buffer.Lines())
+}
+
+func TestItemLogBufferLimitsBytes(t *testing.T) {
+	buffer := newItemLogBuffer(config.ItemLogConfig{MaxLines: 100, MaxBytes: 20})
+	buffer.Add("0123456789")
+	buffer.Add("abcdefghij")
+	buffer.Add("klm")
+	buffer.Add(strings.Repeat("x", 50))
+
+	lines := buffer.Lines()
+	assert.Equal(t, []string{"0123456789", "[... 2 lines (13 bytes) truncated ...]", "xxxx [...]"}, lines)
+}
+
+func TestItemLogBufferWithoutTruncation(t *testing.T) {
+	buffer := newItemLogBuffer(config.ItemLogConfig{})
+	buffer.Add("a")
+	buffer.Add("b")
+	assert.Equal(t, []string{"a", "b"}, buffer.Lines())
+}
+
+func TestItemLogHookSeparatesOverlappingCycles(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	addItemLogHook(log)
+	addItemLogHook(log) // installing the hook twice must not duplicate lines
+
+	// two cycles running the same item at the same time
+	buffers := []*itemLogBuffer{newItemLogBuffer(config.ItemLogConfig{}), newItemLogBuffer(config.ItemLogConfig{})}
+	var wg sync.WaitGroup
+	for cycle, buffer := range buffers {
+		cycle, itemLog := cycle, withItemLogBuffer(log.WithField("item", "item-a"), buffer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				itemLog.Infof("cycle %d line %d", cycle, i)
+			}
+			writer := itemLog.Writer()
+			_, _ = writer.Write([]byte(fmt.Sprintf("cycle %d from writer\n", cycle)))
+			_ = writer.Close()
+		}()
+	}
+	log.WithField("item", "item-a").Info("not collected")
+	wg.Wait()
+
+	for cycle, buffer := range buffers {
+		lines := buffer.Lines()
+		assert.Eventually(t, func() bool {
+			lines = buffer.Lines()
+			return len(lines) == 101
+		}, time.Second, 10*time.Millisecond)
+		for _, line := range lines {
+			assert.True(t, strings.HasPrefix(line, fmt.Sprintf("cycle %d ", cycle)), line)
+		}
+	}
+}
+
+func TestLogCollectorHook(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	hook := NewLogCollectorHook()
+	log.AddHook(hook)
+
+	log.WithField("item", "a").Info("first")
+	log.Info("not collected")
+	logs := hook.GetLogs()
+	log.WithField("item", "a").Info("second")
+	assert.Equal(t, map[string][]string{"a": {"first"}}, logs, "GetLogs returns a copy")
+	assert.Equal(t, []string{"first", "second"}, hook.GetLogs()["a"])
+
+	hook.ClearLogs()
+	assert.Empty(t, hook.GetLogs())
+}
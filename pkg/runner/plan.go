@@ -0,0 +1,282 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/ansible"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/variables"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+)
+
+type PlanAction string
+
+const (
+	PlanActionNew       PlanAction = "new"
+	PlanActionChanged   PlanAction = "changed"
+	PlanActionUnchanged PlanAction = "unchanged"
+	PlanActionRemoved   PlanAction = "removed"
+)
+
+// PlanItem describes what a cycle would do with a single item
+type PlanItem struct {
+	Action           PlanAction `json:"action"`
+	WouldRun         bool       `json:"would_run"`                   // the playbook would be run for the item, for removed items the removal playbooks and the deletion of its files
+	HeldBack         ItemStatus `json:"held_back,omitempty"`         // backoff or quarantined, if the item would not be run because of earlier failures
+	PendingUntil     *time.Time `json:"pending_until,omitempty"`     // end of the grace period of a removed item, see cleanup.grace_period_seconds
+	RemovalPlaybooks []string   `json:"removal_playbooks,omitempty"` // playbooks that are run before the files of a removed item are deleted
+	Diff             string     `json:"diff,omitempty"`              // unified diff of the old and new variables file
+	Error            string     `json:"error,omitempty"`
+	CheckOutput      string     `json:"check_output,omitempty"` // output of ansible-playbook --check --diff
+	CheckError       string     `json:"check_error,omitempty"`
+}
+
+// Plan is the outcome of a dry-run
+type Plan struct {
+	Error string              `json:"error,omitempty"` // the cycle would fail without any changes, e.g. because too many items would be removed, see cleanup.max_removed_ratio
+	Items map[string]PlanItem `json:"items"`
+}
+
+// RunPlan fetches the items from omnikeeper and reports what a cycle would change, without touching the output directory or the state
+// with check, the playbooks of all items that would be run are called with --check --diff, using variables files in a temporary directory
+// the removal playbooks of items that would be removed are called with --check --diff and the item's variables file in the output directory
+func RunPlan(processor Processor, configFile string, check bool, log *logrus.Logger) (Plan, error) {
+	agent, err := NewAgent(processor, configFile, log)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	return agent.Plan(ctx, check)
+}
+
+// Plan reports what a cycle would change, see RunPlan
+func (a *Agent) Plan(ctx context.Context, check bool) (Plan, error) {
+	cfg, log := a.cfg, a.log
+
+	store, err := loadStateStoreReadOnly(cfg.OutputDirectory)
+	if err != nil {
+		return Plan{}, fmt.Errorf("Error loading state: %w", err)
+	}
+
+	client, err := a.client()
+	if err != nil {
+		return Plan{}, fmt.Errorf("Error building omnikeeper GraphQL client: %w", err)
+	}
+	outputItems, err := a.processor.Process(a.configFile, ctx, client, log)
+	if err != nil {
+		return Plan{}, fmt.Errorf("Processing error: %w", err)
+	}
+
+	plan, err := planItems(outputItems, cfg, store, time.Now())
+	if err != nil {
+		return Plan{}, err
+	}
+
+	if check && cfg.Ansible.Disabled {
+		log.Warnf("Not running playbooks in check mode because ansible is disabled")
+	} else if check {
+		err = checkPlannedItems(ctx, plan, outputItems, store, cfg, log)
+		if err != nil {
+			return Plan{}, err
+		}
+	}
+	return plan, nil
+}
+
+// planItems compares the items with the variables files in the output directory, like createVariablesFiles and dueRemovals without writing anything
+func planItems(outputItems map[string]interface{}, cfg config.Configuration, store *state.Store, now time.Time) (Plan, error) {
+	outputDirectory, encoder := cfg.OutputDirectory, cfg.VariablesEncoder()
+	plan := Plan{Items: make(map[string]PlanItem, len(outputItems))}
+	for id, output := range outputItems {
+		newContent, err := encoder.Encode(output)
+		if err != nil {
+			plan.Items[id] = PlanItem{Action: PlanActionChanged, Error: fmt.Sprintf("Error encoding variables: %v", err)}
+			continue
+		}
+
+		item := PlanItem{}
+		oldContent, err := ioutil.ReadFile(buildFullOutputFilename(id, encoder, outputDirectory))
+		switch {
+		case os.IsNotExist(err):
+			item.Action = PlanActionNew
+		case err != nil:
+			return Plan{}, fmt.Errorf("Error reading variables file of item %s: %w", id, err)
+		case bytes.Equal(oldContent, newContent):
+			item.Action = PlanActionUnchanged
+		default:
+			item.Action = PlanActionChanged
+		}
+		if item.Action != PlanActionUnchanged {
+			item.Diff, err = unifiedDiff(buildOutputFilename(id, encoder), oldContent, newContent)
+			if err != nil {
+				return Plan{}, err
+			}
+		}
+
+		switch store.Decide(id, state.HashContent(newContent), now, cfg.Retry.QuarantineAfterFailures) {
+		case state.Run:
+			item.WouldRun = true
+		case state.Unchanged:
+			item.WouldRun = item.Action == PlanActionNew
+		case state.Backoff:
+			item.HeldBack = ItemStatusBackoff
+		case state.Quarantined:
+			item.HeldBack = ItemStatusQuarantined
+		}
+		plan.Items[id] = item
+	}
+
+	// variables files and state of items that are not returned anymore would be removed after their grace period, files that were not written by the agent are kept
+	// NOTE: if the cycle would fail because too many items would be removed, the diffs are still shown, so the removal can be reviewed
+	for _, id := range store.IDs() {
+		if _, ok := outputItems[id]; ok {
+			continue
+		}
+		item := PlanItem{Action: PlanActionRemoved, RemovalPlaybooks: cfg.Ansible.RemovalPlaybooks}
+		itemState, _ := store.Get(id)
+		removedAt := itemState.RemovedAt
+		if removedAt.IsZero() {
+			// the item would be marked as removed by this cycle
+			removedAt = now
+		}
+		dueAt, decision := removalDecision(store, id, removedAt, false, now, cfg.Cleanup, cfg.Retry)
+		switch {
+		case now.Before(dueAt):
+			item.PendingUntil = &dueAt
+		case decision == state.Backoff:
+			item.HeldBack = ItemStatusBackoff
+		case decision == state.Quarantined:
+			item.HeldBack = ItemStatusQuarantined
+		default:
+			item.WouldRun = true
+		}
+		for _, filename := range ownedFiles(id, itemState) {
+			oldJsonOutput, err := ioutil.ReadFile(filepath.Join(outputDirectory, filename))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return Plan{}, fmt.Errorf("Error reading variables file of item %s: %w", id, err)
+			}
+			diff, err := unifiedDiff(filename, oldJsonOutput, nil)
+			if err != nil {
+				return Plan{}, err
+			}
+			item.Diff += diff
+		}
+		plan.Items[id] = item
+	}
+
+	if err := checkRemovedRatio(store, outputItems, nil, cfg.Cleanup); err != nil {
+		plan.Error = err.Error()
+		for id, item := range plan.Items {
+			item.WouldRun = false
+			plan.Items[id] = item
+		}
+	}
+	return plan, nil
+}
+
+func unifiedDiff(filename string, old []byte, new []byte) (string, error) {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(old),
+		B:        splitLines(new),
+		FromFile: "a/" + filename,
+		ToFile:   "b/" + filename,
+		Context:  3,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error creating diff of %s: %w", filename, err)
+	}
+	return diff, nil
+}
+
+// splitLines splits content into lines that all end with a newline, as expected by difflib
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// checkPlannedItems runs the playbooks of all items that would be run and the removal playbooks of all items that would be removed in check mode and adds their output to the plan
+func checkPlannedItems(ctx context.Context, plan Plan, outputItems map[string]interface{}, store *state.Store, cfg config.Configuration, log *logrus.Logger) error {
+	tmpDirectory, err := ioutil.TempDir("", "okda-plan")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDirectory)
+
+	workers := 1
+	if cfg.Ansible.ParallelProcessing {
+		workers = maxParallel(cfg.Ansible)
+	}
+	checkedItems := make(map[string]PlanItem)
+	for id, item := range plan.Items {
+		if item.Action == PlanActionRemoved && len(item.RemovalPlaybooks) == 0 {
+			continue
+		}
+		if item.WouldRun && item.Error == "" {
+			checkedItems[id] = item
+		}
+	}
+
+	var mutex sync.Mutex
+	pool := NewWorkerPool(workers, len(checkedItems))
+	for id, item := range checkedItems {
+		id, item := id, item
+		pool.Submit(func() {
+			if ctx.Err() != nil {
+				return
+			}
+			var output bytes.Buffer
+			var err error
+			if item.Action == PlanActionRemoved {
+				itemState, _ := store.Get(id)
+				removalCfg, variableFile := removalCallout(cfg, ownedFiles(id, itemState))
+				err = ansible.Check(ctx, removalCfg, id, variableFile, &output, log.WithField("item", id))
+			} else {
+				err = checkItem(ctx, id, outputItems[id], cfg.VariablesEncoder(), tmpDirectory, cfg.Ansible, &output, log.WithField("item", id))
+			}
+			item.CheckOutput = output.String()
+			if err != nil {
+				item.CheckError = err.Error()
+			}
+			mutex.Lock()
+			plan.Items[id] = item
+			mutex.Unlock()
+		})
+	}
+	pool.Wait()
+	return ctx.Err()
+}
+
+func checkItem(ctx context.Context, id string, output interface{}, encoder variables.Encoder, tmpDirectory string, ansibleCfg config.AnsibleCalloutConfig, checkOutput *bytes.Buffer, itemLog *logrus.Entry) error {
+	content, err := encoder.Encode(output)
+	if err != nil {
+		return fmt.Errorf("Error encoding variables: %w", err)
+	}
+	variableFile := buildFullOutputFilename(id, encoder, tmpDirectory)
+	err = ioutil.WriteFile(variableFile, content, 0600)
+	if err != nil {
+		return fmt.Errorf("Error writing temporary variables file: %w", err)
+	}
+	return ansible.Check(ctx, ansibleCfg, id, variableFile, checkOutput, itemLog)
+}
@@ -0,0 +1,153 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanItems(t *testing.T) {
+	outputDirectory := t.TempDir()
+	writeFile := func(filename string, content string) {
+		err := ioutil.WriteFile(filepath.Join(outputDirectory, filename), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	unchangedContent := "{\n \"name\": \"a\"\n}"
+	writeFile("unchanged.json", unchangedContent)
+	writeFile("changed.json", "{\n \"name\": \"old\"\n}")
+	writeFile("removed.json", "{\n \"name\": \"gone\"\n}")
+	writeFile("foreign.json", "{}")
+
+	store, err := state.Load(filepath.Join(outputDirectory, state.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.RecordSuccess("unchanged", state.HashContent([]byte(unchangedContent)), now)
+	store.RecordSuccess("changed", "old-hash", now)
+	store.RecordSuccess("removed", "old-hash", now)
+	store.RecordSuccess("removed-without-file", "old-hash", now)
+
+	outputItems := map[string]interface{}{
+		"unchanged": map[string]string{"name": "a"},
+		"changed":   map[string]string{"name": "new"},
+		"new":       map[string]string{"name": "b"},
+	}
+	cfg := config.Configuration{OutputDirectory: outputDirectory, Cleanup: config.CleanupConfig{MaxRemovedRatio: 1}}
+	plan, err := planItems(outputItems, cfg, store, now)
+	assert.NoError(t, err)
+
+	assert.Equal(t, PlanItem{Action: PlanActionUnchanged}, plan.Items["unchanged"])
+	assert.Equal(t, PlanItem{
+		Action:   PlanActionChanged,
+		WouldRun: true,
+		Diff:     "--- a/changed.json\n+++ b/changed.json\n@@ -1,3 +1,3 @@\n {\n- \"name\": \"old\"\n+ \"name\": \"new\"\n }\n",
+	}, plan.Items["changed"])
+	assert.Equal(t, PlanItem{
+		Action:   PlanActionNew,
+		WouldRun: true,
+		Diff:     "--- a/new.json\n+++ b/new.json\n@@ -0,0 +1,3 @@\n+{\n+ \"name\": \"b\"\n+}\n",
+	}, plan.Items["new"])
+	assert.Equal(t, PlanItem{
+		Action:   PlanActionRemoved,
+		WouldRun: true,
+		Diff:     "--- a/removed.json\n+++ b/removed.json\n@@ -1,3 +0,0 @@\n-{\n- \"name\": \"gone\"\n-}\n",
+	}, plan.Items["removed"])
+	assert.Equal(t, PlanItem{Action: PlanActionRemoved, WouldRun: true}, plan.Items["removed-without-file"])
+	assert.Len(t, plan.Items, 5, "files that were not written by the agent are not removed")
+	assert.Empty(t, plan.Error)
+
+	// a cycle that would remove too many items fails without running anything, the plan still shows the diffs
+	cfg.Cleanup.MaxRemovedRatio = 0.25
+	plan, err = planItems(outputItems, cfg, store, now)
+	assert.NoError(t, err)
+	assert.Contains(t, plan.Error, "Refusing to remove 2 of 4 items")
+	assert.False(t, plan.Items["changed"].WouldRun)
+	assert.False(t, plan.Items["removed"].WouldRun)
+	assert.NotEmpty(t, plan.Items["changed"].Diff)
+	assert.Equal(t, "--- a/removed.json\n+++ b/removed.json\n@@ -1,3 +0,0 @@\n-{\n- \"name\": \"gone\"\n-}\n", plan.Items["removed"].Diff)
+
+	// nothing is written
+	content, err := ioutil.ReadFile(filepath.Join(outputDirectory, "changed.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n \"name\": \"old\"\n}", string(content))
+	assert.NoFileExists(t, filepath.Join(outputDirectory, "new.json"))
+	assert.NoFileExists(t, filepath.Join(outputDirectory, state.Filename))
+}
+
+func TestPlanItemsHeldBack(t *testing.T) {
+	outputDirectory := t.TempDir()
+	store, err := state.Load(filepath.Join(outputDirectory, state.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	content := "{\n \"name\": \"a\"\n}"
+	err = ioutil.WriteFile(filepath.Join(outputDirectory, "failing.json"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.RecordFailure("failing", state.HashContent([]byte(content)), assert.AnError, now, func(int) time.Duration { return time.Hour })
+
+	plan, err := planItems(map[string]interface{}{"failing": map[string]string{"name": "a"}}, config.Configuration{OutputDirectory: outputDirectory}, store, now)
+	assert.NoError(t, err)
+	assert.Equal(t, PlanItem{Action: PlanActionUnchanged, HeldBack: ItemStatusBackoff}, plan.Items["failing"])
+}
+
+func TestPlanRemovals(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b"}}
+	agent, dir := newTestAgent(t, processor)
+	callsFile, failFile := useRemovalPlaybook(t, agent, dir)
+	removalPlaybooks := agent.cfg.Ansible.RemovalPlaybooks
+	assert.Equal(t, ExitCodeOK, agent.RunOnce(context.Background()).ExitCode())
+
+	// removals wait for the grace period, which starts with the first cycle that misses the item
+	processor.items = map[string]interface{}{"a": "a"}
+	agent.cfg.Cleanup.GracePeriodSeconds = 3600
+	before := time.Now()
+	plan, err := agent.Plan(context.Background(), false)
+	assert.NoError(t, err)
+	assert.False(t, plan.Items["b"].WouldRun)
+	if assert.NotNil(t, plan.Items["b"].PendingUntil) {
+		assert.False(t, plan.Items["b"].PendingUntil.Before(before.Add(time.Hour)))
+	}
+	assert.Equal(t, removalPlaybooks, plan.Items["b"].RemovalPlaybooks)
+
+	assert.Equal(t, ExitCodeOK, agent.RunOnce(context.Background()).ExitCode())
+	itemState, _ := agent.store.Get("b")
+	plan, err = agent.Plan(context.Background(), false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, plan.Items["b"].PendingUntil) {
+		assert.True(t, itemState.RemovedAt.Add(time.Hour).Equal(*plan.Items["b"].PendingUntil))
+	}
+
+	// once due, the removal playbooks are checked like the playbooks of items that would be run
+	agent.cfg.Cleanup.GracePeriodSeconds = 0
+	plan, err = agent.Plan(context.Background(), true)
+	assert.NoError(t, err)
+	assert.True(t, plan.Items["b"].WouldRun)
+	assert.Nil(t, plan.Items["b"].PendingUntil)
+	assert.Empty(t, plan.Items["b"].CheckError)
+	calls, err := ioutil.ReadFile(callsFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(calls), "--check")
+	assert.Contains(t, string(calls), filepath.Join(dir, "output", "b.json"))
+	assert.FileExists(t, filepath.Join(dir, "output", "b.json"), "the plan never deletes files")
+
+	// failed removals are held back like failed deployments
+	assert.NoError(t, ioutil.WriteFile(failFile, nil, 0600))
+	agent.cfg.Retry.BackoffBaseSeconds = 3600
+	assert.Equal(t, ExitCodeItemsFailed, agent.RunOnce(context.Background()).ExitCode())
+	plan, err = agent.Plan(context.Background(), false)
+	assert.NoError(t, err)
+	assert.False(t, plan.Items["b"].WouldRun)
+	assert.Equal(t, ItemStatusBackoff, plan.Items["b"].HeldBack)
+}
@@ -1,251 +1,497 @@
 package runner
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/ansible"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/fsutil"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/metrics"
 	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/omnikeeper"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/variables"
 
 	"github.com/sirupsen/logrus"
 )
 
-var cfg = config.Configuration{}
-var logCollector = NewLogCollectorHook()
-
+// Run runs the agent of the configuration until SIGTERM or SIGINT, it exits on errors
+// use NewAgent to run several agents in one process
 func Run(processor Processor, configFile string, log *logrus.Logger) {
-	log.Infof("Loading config from file: %s", configFile)
-	err := config.ReadConfigFromFilename(configFile, &cfg)
+	agent, err := NewAgent(processor, configFile, log)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// NOTE: the root context is cancelled on SIGTERM/SIGINT, which stops scheduling of new work
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	err = agent.Run(ctx)
 	if err != nil {
-		log.Fatalf("Error opening config file: %s", err)
+		log.Fatalf("%s", err)
 	}
+}
 
-	parsedLogLevel, err := logrus.ParseLevel(cfg.LogLevel)
+// RunOnce runs a single fetch/write/ansible/post-process cycle and returns its summary, meant for cron jobs and CI pipelines
+// use CycleSummary.ExitCode to map the outcome to an exit code
+func RunOnce(processor Processor, configFile string, log *logrus.Logger) CycleSummary {
+	agent, err := NewAgent(processor, configFile, log)
 	if err != nil {
-		log.Fatalf("Error parsing loglevel in config file: %s", err)
+		log.Fatalf("%s", err)
 	}
-	log.SetLevel(parsedLogLevel)
 
-	// NOTE: touch stats file at the beginning
-	healthcheck.TouchStatFile()
+	defer agent.Close()
 
-	log.AddHook(logCollector)
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	return agent.RunOnce(ctx)
+}
+
+// shutdownContext returns a context that is cancelled on the first SIGTERM/SIGINT
+// NOTE: the signals are released once the context is done, so a second signal kills the process if the shutdown hangs
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// readConfig reads and validates the configuration, see config.ReadConfigFromBytes, it returns the hash of the file's content to detect changes
+func readConfig(configFile string) (config.Configuration, string, error) {
+	cfg := config.Configuration{}
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return cfg, "", fmt.Errorf("Error opening config file: %w", err)
+	}
+	contentHash := state.HashContent(content)
+	err = config.ReadConfigFromBytes(content, &cfg)
+	if err != nil {
+		return cfg, contentHash, fmt.Errorf("Error opening config file: %w", err)
+	}
+	return cfg, contentHash, nil
+}
+
+// configLogFields formats the effective config with the source of every value for logging, secrets are redacted
+func configLogFields(cfg config.Configuration) logrus.Fields {
+	values := make(map[string]string)
+	for _, value := range cfg.Describe() {
+		values[value.Path] = fmt.Sprintf("%s (%s)", value.Value, value.Source)
+	}
+	return logrus.Fields{"config": values}
+}
+
+// withShutdownGracePeriod returns a context for in-flight work that is detached from ctx,
+// but gets cancelled once the grace period has passed after ctx was cancelled
+func withShutdownGracePeriod(ctx context.Context, gracePeriod time.Duration, log *logrus.Logger) (context.Context, context.CancelFunc) {
+	execCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Warnf("Shutting down, waiting up to %v for in-flight playbook runs to finish", gracePeriod)
+			timer := time.NewTimer(gracePeriod)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				log.Errorf("Shutdown grace period of %v expired, cancelling in-flight playbook runs", gracePeriod)
+				cancel()
+			case <-execCtx.Done():
+			}
+		case <-execCtx.Done():
+		}
+	}()
+	return execCtx, cancel
+}
 
-	ticker := time.NewTicker(time.Duration(cfg.CollectIntervalSeconds * int(time.Second)))
-	for ; true; <-ticker.C {
-		runOnce(processor, configFile, cfg, log)
-		ticker.Reset(time.Duration(cfg.CollectIntervalSeconds * int(time.Second)))
+// shutdownGracePeriod returns the configured grace period, the default is filled in by config.SetDefaults, so 0 means none
+func shutdownGracePeriod(cfg config.Configuration) time.Duration {
+	if cfg.ShutdownGracePeriodSeconds > 0 {
+		return time.Duration(cfg.ShutdownGracePeriodSeconds) * time.Second
 	}
+	return 0
 }
 
-func runOnce(processor Processor, configFile string, cfg config.Configuration, log *logrus.Logger) {
-	ctx := context.Background()
+// runOnce runs a single cycle, forced items are run even if their data is unchanged or they are held back because of earlier failures
+func (a *Agent) runOnce(ctx context.Context, forced map[string]bool) (summary CycleSummary) {
+	cfg, log := a.cfg, a.log
+	summary.Items = make(map[string]ItemSummary)
+	// NOTE: forced items are kept for the next cycle if this one fails before running them
+	requeueForced := len(forced) > 0
+	defer func() {
+		if requeueForced {
+			log.Warnf("Keeping %d forced items for the next cycle", len(forced))
+			a.trigger.Requeue(forced)
+		}
+	}()
+	if ctx.Err() != nil {
+		summary.Error = "Cycle not started because of shutdown"
+		summary.NotStarted = true
+		return
+	}
+
+	// in-flight ansible runs and post-processing use their own context, so they can finish during shutdown
+	execCtx, cancelExec := withShutdownGracePeriod(ctx, shutdownGracePeriod(cfg), log)
+	defer cancelExec()
 
 	log.Debugf("Starting processing...")
+	cycleStart := time.Now()
+	a.health.Tick()
+	report := healthcheck.CycleReport{Started: cycleStart}
+	defer func() {
+		a.metrics.CycleDuration.Observe(time.Since(cycleStart).Seconds())
+		report.Finished = time.Now()
+		summary.CycleReport = report
+		err := a.health.CycleFinished(report)
+		if err != nil {
+			log.Errorf("Error touching healthcheck stat file: %v", err)
+		}
+	}()
 
-	okClient, err := omnikeeper.BuildGraphQLClient(ctx, cfg.OmnikeeperBackendUrl, cfg.KeycloakClientId, cfg.Username, cfg.Password, cfg.OmnikeeperInsecureSkipVerify)
+	okClient, err := a.client()
 	if err != nil {
 		log.Errorf("Error building omnikeeper GraphQL client: %v", err)
+		report.Error = fmt.Sprintf("Error building omnikeeper GraphQL client: %v", err)
+		var setupErr *omnikeeper.SetupError
+		if errors.As(err, &setupErr) {
+			// NOTE: a broken local setup is no outage of omnikeeper, see ExitCodeOmnikeeperUnreachable
+			summary.NotStarted = true
+			return
+		}
+		a.metrics.OmnikeeperErrors.Inc()
 		return
 	}
 
 	log.Debugf("Starting fetch from omnikeeper and processing...")
-	outputItems, err := processor.Process(configFile, ctx, okClient, log)
+	queryStart := time.Now()
+	outputItems, err := a.processor.Process(a.configFile, ctx, okClient, log)
+	a.metrics.OmnikeeperQueryDuration.Observe(time.Since(queryStart).Seconds())
 	if err != nil {
 		log.Errorf("Processing error: %v", err)
+		a.metrics.OmnikeeperErrors.Inc()
+		report.Error = fmt.Sprintf("Processing error: %v", err)
 		return
 	}
+	report.OmnikeeperReachable = true
+	report.ItemsFetched = len(outputItems)
 	log.Debugf("Finished fetch from omnikeeper and processing")
 
+	for id := range forced {
+		if _, ok := outputItems[id]; !ok {
+			log.Warnf("Not running forced item %s because it is not returned by omnikeeper anymore, retrying its removal instead", id)
+		}
+	}
+
 	log.Debugf("Creating variables files...")
-	updatedItems, err := createVariablesFiles(outputItems, cfg.OutputDirectory, log)
+	updatedItems, heldBackItems, writeErrors, err := a.createVariablesFiles(outputItems, forced)
 	if err != nil {
 		log.Errorf("Error creating variables files: %v", err)
+		report.Error = fmt.Sprintf("Error creating variables files: %v", err)
 		return
 	}
 	log.Debugf("Finished creating variables files")
+	requeueForced = false
+	removedItems := a.dueRemovals(outputItems, forced, time.Now())
 
-	logCollector.ClearLogs()
+	// NOTE: logs are collected per cycle, so a cycle never sees logs of another one
+	itemLogs := make(map[string]*itemLogBuffer, len(updatedItems)+len(removedItems))
+	for id := range updatedItems {
+		itemLogs[id] = newItemLogBuffer(cfg.ItemLogs)
+	}
+	for _, id := range removedItems {
+		itemLogs[id] = newItemLogBuffer(cfg.ItemLogs)
+	}
 
 	itemErr := make(map[string][]error)
+	itemAnsibleResults := make(map[string]*ansible.Result)
 	itemErrMutex := &sync.Mutex{}
-	if len(updatedItems) > 0 {
-		log.Debugf("Running ansible for updated items...")
+	skippedItems := make(map[string]bool)
+	removalResults := make(map[string]ProcessResultItem)
+	if len(updatedItems) > 0 || len(removedItems) > 0 {
+		log.Debugf("Running ansible for updated and removed items...")
 
+		workers := 1
 		if cfg.Ansible.ParallelProcessing {
-			log.Debugf("Running in parallel...")
-			// parallel processing of playbooks
-			var wg sync.WaitGroup
-			wg.Add(len(updatedItems))
-
-			for id := range updatedItems {
-				itemLog := log.WithField("item", id)
-				go func(id string) {
-					defer wg.Done()
-
-					err := runItem(id, ctx, itemLog)
-					if err != nil {
-						itemErrMutex.Lock()
-						itemErr[id] = append(itemErr[id], err)
-						itemErrMutex.Unlock()
-					}
-				}(id)
-			}
-			wg.Wait()
+			workers = maxParallel(cfg.Ansible)
+			log.Debugf("Running in parallel (max. %d concurrent runs)...", workers)
 		} else {
 			log.Debugf("Running in series...")
-			// serial processing of playbooks
-			for id := range updatedItems {
-				itemLog := log.WithField("item", id)
-				err := runItem(id, ctx, itemLog)
+		}
+
+		pool := NewWorkerPool(workers, len(updatedItems)+len(removedItems))
+		for id, contentHash := range updatedItems {
+			id, contentHash := id, contentHash
+			itemLog := withItemLogBuffer(log.WithField("item", id), itemLogs[id])
+			pool.Submit(func() {
+				if ctx.Err() != nil {
+					// shutting down, do not start any new playbook runs
+					// the item's state is left untouched, so it is run again on next start
+					itemErrMutex.Lock()
+					skippedItems[id] = true
+					itemErrMutex.Unlock()
+					return
+				}
+				ansibleResult, err := a.runItem(id, contentHash, execCtx, itemLog)
+				a.health.Tick()
+				itemErrMutex.Lock()
+				itemAnsibleResults[id] = ansibleResult
 				if err != nil {
 					itemErr[id] = append(itemErr[id], err)
 				}
-			}
+				itemErrMutex.Unlock()
+			})
+		}
+		for _, id := range removedItems {
+			id := id
+			itemLog := withItemLogBuffer(log.WithField("item", id), itemLogs[id])
+			pool.Submit(func() {
+				if ctx.Err() != nil {
+					// NOTE: the item stays marked as removed, so its removal is retried on next start
+					return
+				}
+				result := a.removeItem(id, execCtx, itemLog)
+				a.health.Tick()
+				itemErrMutex.Lock()
+				removalResults[id] = result
+				itemErrMutex.Unlock()
+			})
 		}
+		pool.Wait()
 
-		log.Debugf("Finished running ansible for updated items...")
+		if len(skippedItems) > 0 {
+			log.Warnf("Skipped %d items because of shutdown... skipped items will be run on next start", len(skippedItems))
+		}
+
+		log.Debugf("Finished running ansible for updated and removed items...")
 	} else {
-		log.Debugf("Skipping running ansible because no items were updated")
+		log.Debugf("Skipping running ansible because no items were updated or removed")
+	}
+	if len(heldBackItems) > 0 {
+		log.Infof("Not running %d failed items that are in backoff or quarantine", len(heldBackItems))
+	}
+
+	err = a.store.Save()
+	if err != nil {
+		log.Errorf("Error saving state: %v", err)
 	}
 
-	if len(itemErr) == 0 {
-		healthcheck.TouchStatFile()
+	ranItems := len(updatedItems) - len(skippedItems)
+	a.metrics.ObserveCycleItems(len(outputItems), len(updatedItems), ranItems-len(itemErr), len(itemErr))
+	report.ItemsUpdated = len(updatedItems)
+	report.ItemsSucceeded = ranItems - len(itemErr)
+	report.ItemsFailed = len(itemErr) + len(heldBackItems) + len(writeErrors)
+	failedRemovals := 0
+	for _, result := range removalResults {
+		if !result.Success {
+			failedRemovals++
+		}
+	}
+	report.ItemsFailed += failedRemovals
+
+	if len(itemErr) == 0 && len(skippedItems) == 0 && len(writeErrors) == 0 && failedRemovals == 0 {
+		report.Successful = true
+		a.metrics.LastSuccessfulCycleTimestamp.SetToCurrentTime()
 	} else {
 		log.Errorf("Encountered errors in %d items... items with errors will be re-run", len(itemErr))
 	}
 
 	// post-process
 	results := make(map[string]ProcessResultItem)
-	itemLogs := logCollector.GetLogs()
-	for id, logs := range itemLogs {
+	for id := range updatedItems {
+		if skippedItems[id] {
+			continue
+		}
+		var firstErr error
+		status := ItemStatusSucceeded
+		if len(itemErr[id]) > 0 {
+			firstErr = itemErr[id][0]
+			status = ItemStatusFailed
+		}
+		itemState, _ := a.store.Get(id)
 		results[id] = ProcessResultItem{
-			Logs:     logs,
-			Success:  len(itemErr[id]) <= 0,
-			BaseData: outputItems[id],
+			Logs:          itemLogs[id].Lines(),
+			AnsibleResult: itemAnsibleResults[id],
+			Success:       len(itemErr[id]) <= 0,
+			Status:        status,
+			TimedOut:      errors.Is(firstErr, ansible.ErrTimeout),
+			Error:         firstErr,
+			FailureCount:  itemState.FailureCount,
+			NextAttempt:   itemState.NextAttempt,
+			Finished:      itemState.LastAttempt,
+			VariablesHash: updatedItems[id],
+			BaseData:      outputItems[id],
 		}
 	}
-	err = processor.PostProcess(configFile, ctx, okClient, log, results)
+	for id, status := range heldBackItems {
+		itemState, _ := a.store.Get(id)
+		results[id] = ProcessResultItem{
+			Success:       false,
+			Status:        status,
+			Error:         errors.New(itemState.LastError),
+			FailureCount:  itemState.FailureCount,
+			NextAttempt:   itemState.NextAttempt,
+			Finished:      itemState.LastAttempt,
+			VariablesHash: itemState.FailedContentHash,
+			BaseData:      outputItems[id],
+		}
+	}
+	for id, result := range removalResults {
+		result.Logs = itemLogs[id].Lines()
+		results[id] = result
+		summary.Items[id] = summarizeResult(result)
+	}
+	if cfg.WriteBack.Enabled {
+		for id, err := range a.writeBackResults(execCtx, okClient, results) {
+			result := results[id]
+			result.WriteBackError = err
+			results[id] = result
+		}
+	}
+	for id := range outputItems {
+		if result, ok := results[id]; ok {
+			summary.Items[id] = summarizeResult(result)
+		} else if writeErr, ok := writeErrors[id]; ok {
+			summary.Items[id] = ItemSummary{Status: ItemStatusFailed, Error: writeErr.Error()}
+		} else if skippedItems[id] {
+			summary.Items[id] = ItemSummary{Status: ItemStatusSkipped}
+		} else {
+			summary.Items[id] = ItemSummary{Status: ItemStatusUnchanged}
+		}
+	}
+
+	err = a.processor.PostProcess(a.configFile, execCtx, okClient, log, results)
 	if err != nil {
 		log.Errorf("Error post-processing: %v", err)
+		report.Error = fmt.Sprintf("Error post-processing: %v", err)
 		return
 	}
 
 	log.Debugf("Finished processing")
+	return
+}
+
+func maxParallel(cfg config.AnsibleCalloutConfig) int {
+	if cfg.MaxParallel > 0 {
+		return cfg.MaxParallel
+	}
+	return runtime.NumCPU()
 }
 
-func runItem(id string, ctx context.Context, itemLog *logrus.Entry) error {
-	fullOutputFilename := buildFullOutputFilename(id, cfg.OutputDirectory)
-	ansibleItemErr := ansible.Callout(ctx, cfg.Ansible, id, fullOutputFilename, cfg.Ansible.Disabled, itemLog)
+func (a *Agent) runItem(id string, contentHash string, ctx context.Context, itemLog *logrus.Entry) (*ansible.Result, error) {
+	fullOutputFilename := buildFullOutputFilename(id, a.cfg.VariablesEncoder(), a.cfg.OutputDirectory)
+	playbookStart := time.Now()
+	ansibleResult, ansibleItemErr := ansible.Callout(ctx, a.cfg.Ansible, id, fullOutputFilename, a.cfg.Ansible.Disabled, itemLog)
+	a.metrics.PlaybookDuration.WithLabelValues(playbookResult(ansibleItemErr)).Observe(time.Since(playbookStart).Seconds())
 
-	fullProcessedFilename := buildFullProcessedFilename(id, cfg.OutputDirectory)
 	if ansibleItemErr != nil {
 		itemLog.Errorf("Error running ansible for item %s: %v", id, ansibleItemErr)
-		// delete the .processed file, if present
-		_ = os.Remove(fullProcessedFilename)
-		return ansibleItemErr
-	} else {
-		// place a .processed file to indicate that ansible successfully processed the host
-		_, err := os.OpenFile(fullProcessedFilename, os.O_RDONLY|os.O_CREATE, 0666)
-		if err != nil {
-			// can't do much else other than report the error
-			itemLog.Errorf("Error writing .processed file for item %s: %v", id, err)
-			return err
-		}
+		a.store.RecordFailure(id, contentHash, ansibleItemErr, time.Now(), func(failureCount int) time.Duration {
+			return retryDelay(a.cfg.Retry, failureCount)
+		})
+		return ansibleResult, ansibleItemErr
 	}
-	return nil
+	a.store.RecordSuccess(id, contentHash, time.Now())
+	return ansibleResult, nil
 }
 
-func buildProcessedFilename(id string) string {
-	return id + ".processed"
-}
-func buildFullProcessedFilename(id string, outputDirectory string) string {
-	return filepath.Join(outputDirectory, buildProcessedFilename(id))
+// playbookResult returns the result label of the playbook duration metric
+func playbookResult(err error) string {
+	if errors.Is(err, ansible.ErrTimeout) {
+		return metrics.ResultTimeout
+	} else if err != nil {
+		return metrics.ResultFailure
+	}
+	return metrics.ResultSuccess
 }
-func buildOutputFilename(id string) string {
-	return id + ".json"
+
+func buildOutputFilename(id string, encoder variables.Encoder) string {
+	return id + encoder.Extension()
 }
-func buildFullOutputFilename(id string, outputDirectory string) string {
-	return filepath.Join(outputDirectory, buildOutputFilename(id))
+func buildFullOutputFilename(id string, encoder variables.Encoder, outputDirectory string) string {
+	return filepath.Join(outputDirectory, buildOutputFilename(id, encoder))
 }
 
-func createVariablesFiles(outputItems map[string]interface{}, outputDirectory string, log *logrus.Logger) (map[string]bool, error) {
+// createVariablesFiles writes the variables files of all items that need to be run and returns their IDs with the hash of their content
+// failed items that are not retried in this cycle and items whose variables file could not be written are returned separately, forced items are always run
+func (a *Agent) createVariablesFiles(outputItems map[string]interface{}, forced map[string]bool) (map[string]string, map[string]ItemStatus, map[string]error, error) {
+	outputDirectory, store, retryCfg, log := a.cfg.OutputDirectory, a.store, a.cfg.Retry, a.log
+	encoder := a.cfg.VariablesEncoder()
+	fileMode, dirMode := a.cfg.FileModes()
 	if _, err := os.Stat(outputDirectory); os.IsNotExist(err) {
-		err = os.Mkdir(outputDirectory, os.ModePerm)
+		err = os.Mkdir(outputDirectory, dirMode)
 		if err != nil {
-			return nil, fmt.Errorf("Error creating output directory: %w", err)
+			return nil, nil, nil, fmt.Errorf("Error creating output directory: %w", err)
 		}
 	}
-	processedFiles := make(map[string]bool, len(outputItems))
-	updatedItems := make(map[string]bool, len(outputItems))
+	err := checkRemovedRatio(store, outputItems, forced, a.cfg.Cleanup)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	updatedItems := make(map[string]string, len(outputItems))
+	heldBackItems := make(map[string]ItemStatus)
+	writeErrors := make(map[string]error)
 	for id, output := range outputItems {
-		newJsonOutput, err := json.MarshalIndent(output, "", " ")
+		newContent, err := encoder.Encode(output)
 		if err != nil {
-			log.Errorf("Error marshalling output JSON for ID %s: %v", id, err)
+			log.Errorf("Error encoding variables for ID %s: %v", id, err)
+			a.metrics.VariableFileWriteErrors.Inc()
+			writeErrors[id] = fmt.Errorf("Error encoding variables: %w", err)
 			continue
 		}
-		outputFilename := buildOutputFilename(id)
-		fullOutputFilename := buildFullOutputFilename(id, outputDirectory)
-
-		oldFile, err := os.Open(fullOutputFilename)
-		defer oldFile.Close()
-		var oldJsonOutput []byte = nil
-		if err == nil {
-			// an old file exists, read it
-			readOldJsonOutput, err := ioutil.ReadAll(oldFile)
-			if err != nil {
-				// if we cannot read it, log a warning, but otherwise continue
-				log.Warningf("Error reading existing output file %s: %v", outputFilename, err)
-			} else {
-				oldJsonOutput = readOldJsonOutput
-			}
+		outputFilename := buildOutputFilename(id, encoder)
+		fullOutputFilename := buildFullOutputFilename(id, encoder, outputDirectory)
+
+		contentHash := state.HashContent(newContent)
+		_, errStat := os.Stat(fullOutputFilename)
+		decision := store.Decide(id, contentHash, now, retryCfg.QuarantineAfterFailures)
+		if forced[id] {
+			decision = state.Run
 		}
-
-		processedFilename := buildProcessedFilename(id)
-		fullProcessedFilename := buildFullProcessedFilename(id, outputDirectory)
-		_, errFPCheck := os.Stat(fullProcessedFilename)
-		processedFileExists := !os.IsNotExist(errFPCheck)
-
-		// first check if a processed file exists
-		// then, compare old and new data, byte-by-byte, write/update output file only if a difference was detected
-		if !processedFileExists || bytes.Compare(oldJsonOutput, newJsonOutput) != 0 {
-			err = ioutil.WriteFile(fullOutputFilename, newJsonOutput, os.ModePerm)
+		switch decision {
+		case state.Backoff:
+			heldBackItems[id] = ItemStatusBackoff
+		case state.Quarantined:
+			heldBackItems[id] = ItemStatusQuarantined
+		}
+		if decision == state.Run || (decision == state.Unchanged && os.IsNotExist(errStat)) {
+			// NOTE: playbooks that are still running from an earlier cycle may read the file at any time, so it is replaced atomically
+			err = fsutil.WriteFileAtomic(fullOutputFilename, newContent, fileMode)
 			if err != nil {
-				log.Errorf("Error writing output JSON for ID %s: %v", id, err)
+				log.Errorf("Error writing variables file for ID %s: %v", id, err)
+				a.metrics.VariableFileWriteErrors.Inc()
+				writeErrors[id] = fmt.Errorf("Error writing variables file: %w", err)
 				continue
 			}
-			updatedItems[id] = true
+			updatedItems[id] = contentHash
 			log.Tracef("Updated variable file %s", outputFilename)
 		}
 
-		processedFiles[outputFilename] = true
-		processedFiles[processedFilename] = true
-	}
-	// delete old items (i.e. files that have not been processed)
-	dirRead, _ := os.Open(outputDirectory)
-	defer dirRead.Close()
-	dirFiles, _ := dirRead.Readdir(0)
-	for index := range dirFiles {
-		fileHere := dirFiles[index]
-		filename := fileHere.Name()
-
-		if !processedFiles[filename] {
-			fullFilename := filepath.Join(outputDirectory, filename)
-			err := os.Remove(fullFilename)
-			if err != nil {
-				log.Errorf("Error deleting old file %s: %v", filename, err)
-				continue
+		// NOTE: files of another output_format are deleted, they are not needed anymore once the item was written in the new format
+		// items without state were never written by the agent, so they own no files yet
+		if itemState, ok := store.Get(id); ok {
+			for _, filename := range ownedFiles(id, itemState) {
+				if filename != outputFilename {
+					err = deleteFiles(outputDirectory, []string{filename})
+					if err != nil {
+						log.Errorf("Error deleting old variables file of item %s: %v", id, err)
+					}
+				}
 			}
 		}
+		store.SetFiles(id, []string{outputFilename})
 	}
-	return updatedItems, nil
+	return updatedItems, heldBackItems, writeErrors, nil
 }
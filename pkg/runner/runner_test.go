@@ -0,0 +1,169 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b", "c": "c"}}
+	agent, dir := newTestAgent(t, processor)
+
+	// fake ansible-playbook that signals its start and takes a while to finish
+	startedFile := filepath.Join(dir, "started")
+	binary := filepath.Join(dir, "ansible-playbook")
+	script := fmt.Sprintf("#!/bin/sh\ntouch %s\nsleep 1\necho '{\"plays\": [], \"stats\": {}}'\n", startedFile)
+	assert.NoError(t, ioutil.WriteFile(binary, []byte(script), 0700))
+	agent.cfg.Ansible.Disabled = false
+	agent.cfg.Ansible.ParallelProcessing = false
+	agent.cfg.Ansible.Playbooks = []string{"../../contrib/sample-playbook.yml"}
+	agent.cfg.Ansible.AnsibleBinary = binary
+	agent.cfg.ShutdownGracePeriodSeconds = 10
+
+	// shut down while the first item is running
+	assert.NoError(t, agent.open())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(startedFile); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	summary := agent.runOnce(ctx, nil)
+
+	statuses := make(map[ItemStatus][]string)
+	for id, item := range summary.Items {
+		statuses[item.Status] = append(statuses[item.Status], id)
+	}
+	assert.Len(t, statuses[ItemStatusSucceeded], 1, "the running item finishes within the grace period")
+	assert.Len(t, statuses[ItemStatusSkipped], 2, "items that were not started yet are skipped")
+	assert.Empty(t, statuses[ItemStatusFailed])
+	assert.Len(t, processor.results, 1)
+
+	// skipped items are not marked as failed, they are run on next start
+	for _, id := range statuses[ItemStatusSkipped] {
+		item, ok := agent.store.Get(id)
+		if ok {
+			assert.Zero(t, item.FailureCount)
+			assert.Empty(t, item.ContentHash)
+		}
+	}
+}
+
+func TestCycleMetrics(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a", "b": "b", "c": "c"}}
+	agent, dir := newTestAgent(t, processor)
+
+	// fake ansible-playbook that fails for item b
+	binary := filepath.Join(dir, "ansible-playbook")
+	script := "#!/bin/sh\ncase \"$*\" in *b.json*) exit 2;; esac\necho '{\"plays\": [], \"stats\": {}}'\n"
+	assert.NoError(t, ioutil.WriteFile(binary, []byte(script), 0700))
+	agent.cfg.Ansible.Disabled = false
+	agent.cfg.Ansible.Playbooks = []string{"../../contrib/sample-playbook.yml"}
+	agent.cfg.Ansible.AnsibleBinary = binary
+
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeItemsFailed, summary.ExitCode())
+
+	rec := httptest.NewRecorder()
+	agent.metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	assert.Contains(t, body, `okda_last_cycle_items{status="fetched"} 3`)
+	assert.Contains(t, body, `okda_last_cycle_items{status="succeeded"} 2`)
+	assert.Contains(t, body, `okda_last_cycle_items{status="failed"} 1`)
+	assert.Contains(t, body, `okda_items_total{status="succeeded"} 2`)
+	assert.Contains(t, body, `okda_items_total{status="failed"} 1`)
+	assert.Contains(t, body, `okda_playbook_duration_seconds_count{result="success"} 2`)
+	assert.Contains(t, body, `okda_playbook_duration_seconds_count{result="failure"} 1`)
+	assert.Contains(t, body, "okda_cycle_duration_seconds_count 1")
+}
+
+func TestForcedItemsSurviveFailedCycle(t *testing.T) {
+	processor := &staticProcessor{items: map[string]interface{}{"a": "a"}}
+	agent, _ := newTestAgent(t, processor)
+	agent.RunOnce(context.Background())
+
+	processor.err = errors.New("omnikeeper is down")
+	agent.runOnce(context.Background(), map[string]bool{"a": true})
+	assert.True(t, agent.trigger.IsForced("a"), "the forced item is kept for the next cycle")
+	assert.False(t, triggered(agent.trigger), "the failed cycle is not retried right away")
+
+	processor.err = nil
+	summary := agent.runOnce(context.Background(), agent.trigger.TakeForced())
+	assert.Equal(t, ItemStatusSucceeded, summary.Items["a"].Status, "the unchanged item is run because it is still forced")
+	assert.False(t, agent.trigger.IsForced("a"))
+}
+
+func TestClientSetupExitCodes(t *testing.T) {
+	// local problems of the client setup are errors of the agent, not of omnikeeper
+	for name, setup := range map[string]func(cfg *config.Configuration, dir string){
+		"missing CA file":    func(cfg *config.Configuration, dir string) { cfg.OmnikeeperCAFile = filepath.Join(dir, "missing.pem") },
+		"missing token file": func(cfg *config.Configuration, dir string) { cfg.Auth.TokenFile = filepath.Join(dir, "missing") },
+		"incomplete key pair": func(cfg *config.Configuration, dir string) {
+			cfg.OmnikeeperClientCertFile = filepath.Join(dir, "cert.pem")
+		},
+		"missing private key": func(cfg *config.Configuration, dir string) {
+			cfg.Auth.Mode = config.AuthModeClientCredentials
+			cfg.Auth.PrivateKeyFile = filepath.Join(dir, "missing.pem")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			agent, dir := newTestAgent(t, &staticProcessor{})
+			setup(&agent.cfg, dir)
+			if agent.cfg.Auth.Mode == config.AuthModeClientCredentials {
+				// NOTE: the key is read after the discovery, which needs a reachable server
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(`{"token_endpoint": "http://localhost:1/token"}`))
+				}))
+				defer server.Close()
+				agent.cfg.OmnikeeperBackendUrl = server.URL
+			}
+			summary := agent.RunOnce(context.Background())
+			assert.Equal(t, ExitCodeError, summary.ExitCode(), summary.Error)
+			assert.True(t, summary.NotStarted)
+		})
+	}
+
+	// an unreachable OAuth server is an outage of omnikeeper
+	agent, _ := newTestAgent(t, &staticProcessor{})
+	agent.cfg.Auth.Mode = config.AuthModePassword
+	summary := agent.RunOnce(context.Background())
+	assert.Equal(t, ExitCodeOmnikeeperUnreachable, summary.ExitCode(), summary.Error)
+	assert.Contains(t, summary.Error, "openid-configuration")
+}
+
+func TestLivenessBetweenCycles(t *testing.T) {
+	agent, _ := newTestAgent(t, &staticProcessor{})
+	agent.cfg.HealthcheckThresholdSeconds = 1
+	agent.health = healthcheck.NewTracker(agent.cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- agent.Run(ctx)
+	}()
+
+	// the agent waits 10 seconds for the next cycle, it stays alive with a threshold below the collect interval
+	time.Sleep(1500 * time.Millisecond)
+	_, alive := agent.health.Liveness()
+	assert.True(t, alive)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,127 @@
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+)
+
+const legacyProcessedSuffix = ".processed"
+
+// legacyVariablesFileSuffix is the suffix of the variables files of older versions, which always wrote JSON
+const legacyVariablesFileSuffix = ".json"
+
+// openStateStore loads the state store from the output directory, which is created with dirMode if it does not exist
+// on first start, the state is migrated from the .processed marker files of older versions
+func openStateStore(outputDirectory string, dirMode os.FileMode, log *logrus.Logger) (*state.Store, error) {
+	err := os.MkdirAll(outputDirectory, dirMode)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating output directory: %w", err)
+	}
+
+	stateFilename := filepath.Join(outputDirectory, state.Filename)
+	_, errStat := os.Stat(stateFilename)
+	store, err := state.Load(stateFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.IsNotExist(errStat) {
+		migrated, err := migrateProcessedFiles(outputDirectory, store)
+		if err != nil {
+			return nil, fmt.Errorf("Error migrating .processed files: %w", err)
+		}
+		err = store.Save()
+		if err != nil {
+			return nil, err
+		}
+		if len(migrated) > 0 {
+			log.Infof("Migrated %d .processed files to state file %s", len(migrated), stateFilename)
+			for _, f := range migrated {
+				_ = os.Remove(f)
+			}
+		}
+	}
+	return store, nil
+}
+
+// restrictPermissions applies the configured permissions to an existing output directory and the variables files of all items in the store
+// older versions created them world-readable, failures are logged only, as the agent can work anyway
+func restrictPermissions(outputDirectory string, store *state.Store, fileMode os.FileMode, dirMode os.FileMode, log *logrus.Logger) {
+	dirInfo, err := os.Stat(outputDirectory)
+	if err == nil && dirInfo.Mode().Perm() != dirMode {
+		err = os.Chmod(outputDirectory, dirMode)
+	}
+	if err != nil {
+		log.Warnf("Error restricting permissions of output directory %s: %v", outputDirectory, err)
+	}
+
+	for _, id := range store.IDs() {
+		item, _ := store.Get(id)
+		for _, filename := range ownedFiles(id, item) {
+			fullFilename := filepath.Join(outputDirectory, filename)
+			info, err := os.Stat(fullFilename)
+			if os.IsNotExist(err) || (err == nil && info.Mode().Perm() == fileMode) {
+				continue
+			}
+			if err == nil {
+				err = os.Chmod(fullFilename, fileMode)
+			}
+			if err != nil {
+				log.Warnf("Error restricting permissions of variables file %s: %v", filename, err)
+			}
+		}
+	}
+}
+
+// loadStateStoreReadOnly loads the state store like openStateStore, but never writes to the output directory
+// .processed files of older versions are migrated in memory only
+func loadStateStoreReadOnly(outputDirectory string) (*state.Store, error) {
+	stateFilename := filepath.Join(outputDirectory, state.Filename)
+	_, errStat := os.Stat(stateFilename)
+	store, err := state.Load(stateFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.IsNotExist(errStat) {
+		_, err = migrateProcessedFiles(outputDirectory, store)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error migrating .processed files: %w", err)
+		}
+	}
+	return store, nil
+}
+
+// migrateProcessedFiles records every item with a .processed file and an existing variables file as successfully run, returns the migrated .processed files
+func migrateProcessedFiles(outputDirectory string, store *state.Store) ([]string, error) {
+	dirFiles, err := ioutil.ReadDir(outputDirectory)
+	if err != nil {
+		return nil, err
+	}
+	migrated := make([]string, 0)
+	for _, f := range dirFiles {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), legacyProcessedSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), legacyProcessedSuffix)
+		fullProcessedFilename := filepath.Join(outputDirectory, f.Name())
+
+		content, err := ioutil.ReadFile(filepath.Join(outputDirectory, id+legacyVariablesFileSuffix))
+		if err == nil {
+			store.Set(id, state.ItemState{
+				ContentHash:       state.HashContent(content),
+				LastSuccessfulRun: f.ModTime(),
+				LastAttempt:       f.ModTime(),
+			})
+		}
+		// NOTE: .processed files without variables file are dropped, the item is run again anyway
+		migrated = append(migrated, fullProcessedFilename)
+	}
+	return migrated, nil
+}
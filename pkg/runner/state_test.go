@@ -0,0 +1,44 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/state"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenStateStoreMigratesProcessedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("processed.json", `{"name": "foo"}`)
+	writeFile("processed.processed", "")
+	writeFile("unprocessed.json", `{"name": "bar"}`)
+	writeFile("orphan.processed", "")
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	store, err := openStateStore(dir, 0700, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"processed"}, store.IDs())
+	now := time.Now()
+	assert.Equal(t, state.Unchanged, store.Decide("processed", state.HashContent([]byte(`{"name": "foo"}`)), now, 0))
+	assert.Equal(t, state.Run, store.Decide("unprocessed", state.HashContent([]byte(`{"name": "bar"}`)), now, 0))
+
+	_, err = os.Stat(filepath.Join(dir, "processed.processed"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, state.Filename))
+	assert.NoError(t, err)
+}
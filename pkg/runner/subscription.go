@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/config"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/omnikeeper"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSubscriptionDebounce       = config.DefaultSubscriptionDebounceSeconds * time.Second
+	defaultSubscriptionReconnectDelay = config.DefaultSubscriptionReconnectDelaySeconds * time.Second
+)
+
+// watchSubscription subscribes to omnikeeper change notifications until ctx is done and triggers a cycle once notifications settle down
+// lost subscriptions are re-established after the reconnect delay, polling continues in the meantime
+// every connection attempt gets the current config and HTTP client from connection, so reconnects reuse its token and follow config reloads
+func watchSubscription(ctx context.Context, subscriptionCfg config.SubscriptionConfig, connection func() (config.Configuration, *http.Client, error), trigger *cycleTrigger, log *logrus.Logger) {
+	debounce := defaultSubscriptionDebounce
+	if subscriptionCfg.DebounceSeconds > 0 {
+		debounce = time.Duration(subscriptionCfg.DebounceSeconds) * time.Second
+	}
+	reconnectDelay := defaultSubscriptionReconnectDelay
+	if subscriptionCfg.ReconnectDelaySeconds > 0 {
+		reconnectDelay = time.Duration(subscriptionCfg.ReconnectDelaySeconds) * time.Second
+	}
+
+	changes := make(chan struct{}, 1)
+	go debounceChanges(ctx, changes, debounce, func() {
+		log.Debugf("Triggering cycle because of changes in omnikeeper")
+		trigger.Trigger()
+	})
+
+	for {
+		log.Infof("Subscribing to changes in layers %v", subscriptionCfg.Layers)
+		cfg, httpClient, err := connection()
+		if err == nil {
+			err = omnikeeper.SubscribeToLayerChanges(ctx, cfg, httpClient, subscriptionCfg.Query, subscriptionCfg.Layers, func() {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Subscription to omnikeeper changes lost, reconnecting in %v: %v", reconnectDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// debounceChanges calls fn once no further change arrived for the debounce duration
+func debounceChanges(ctx context.Context, changes <-chan struct{}, debounce time.Duration, fn func()) {
+	timer := time.NewTimer(debounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-changes:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			fn()
+		}
+	}
+}
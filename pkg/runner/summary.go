@@ -0,0 +1,83 @@
+package runner
+
+import (
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/ansible"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
+)
+
+// Exit codes for the outcome of a single cycle, see CycleSummary.ExitCode
+const (
+	ExitCodeOK                    = 0
+	ExitCodeError                 = 1 // the cycle could not be completed, e.g. the output directory is not writable
+	ExitCodeItemsFailed           = 2 // at least one item failed or was not run
+	ExitCodeOmnikeeperUnreachable = 3
+)
+
+// statuses that only appear in the summary, items with these statuses are not passed to PostProcess
+const (
+	ItemStatusUnchanged ItemStatus = "unchanged" // not run, the item's data did not change since its last successful run
+	ItemStatusSkipped   ItemStatus = "skipped"   // not run because of shutdown, the item is run on next start
+)
+
+// CycleSummary is the machine-readable outcome of a single cycle, including the result of every item
+type CycleSummary struct {
+	healthcheck.CycleReport
+	NotStarted bool                   `json:"not_started,omitempty"` // the cycle failed before contacting omnikeeper, e.g. because the output directory is locked, a CA, key or token file is unreadable or of shutdown
+	Items      map[string]ItemSummary `json:"items"`
+}
+
+type ItemSummary struct {
+	Status       ItemStatus `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	TimedOut     bool       `json:"timed_out,omitempty"`
+	FailureCount int        `json:"failure_count,omitempty"`
+	NextAttempt  *time.Time `json:"next_attempt,omitempty"`
+
+	Hosts       map[string]ansible.HostStats `json:"hosts,omitempty"`        // play recap per host
+	FailedTasks []string                     `json:"failed_tasks,omitempty"` // messages of failed and unreachable tasks
+
+	WriteBackError string `json:"write_back_error,omitempty"`
+}
+
+// ExitCode maps the outcome of the cycle to the exit code of the --once mode
+func (s CycleSummary) ExitCode() int {
+	switch {
+	case s.NotStarted:
+		return ExitCodeError
+	case !s.OmnikeeperReachable:
+		return ExitCodeOmnikeeperUnreachable
+	case s.Error != "":
+		return ExitCodeError
+	case !s.Successful || s.ItemsFailed > 0:
+		return ExitCodeItemsFailed
+	default:
+		return ExitCodeOK
+	}
+}
+
+func summarizeResult(result ProcessResultItem) ItemSummary {
+	summary := ItemSummary{
+		Status:       result.Status,
+		TimedOut:     result.TimedOut,
+		FailureCount: result.FailureCount,
+	}
+	if result.Error != nil {
+		summary.Error = result.Error.Error()
+	}
+	if result.WriteBackError != nil {
+		summary.WriteBackError = result.WriteBackError.Error()
+	}
+	if result.AnsibleResult != nil {
+		summary.Hosts = result.AnsibleResult.Hosts
+		if errs := result.AnsibleResult.Errors(); len(errs) > 0 {
+			summary.FailedTasks = errs
+		}
+	}
+	if !result.NextAttempt.IsZero() {
+		nextAttempt := result.NextAttempt
+		summary.NextAttempt = &nextAttempt
+	}
+	return summary
+}
@@ -0,0 +1,29 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/healthcheck"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCycleSummaryExitCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		report     healthcheck.CycleReport
+		notStarted bool
+		expected   int
+	}{
+		{"all items ok", healthcheck.CycleReport{OmnikeeperReachable: true, Successful: true, ItemsFetched: 2}, false, ExitCodeOK},
+		{"omnikeeper unreachable", healthcheck.CycleReport{Error: "connection refused"}, false, ExitCodeOmnikeeperUnreachable},
+		{"error after fetching", healthcheck.CycleReport{OmnikeeperReachable: true, Error: "Error creating variables files"}, false, ExitCodeError},
+		{"not started", healthcheck.CycleReport{Error: "Cycle not started because of shutdown"}, true, ExitCodeError},
+		{"failed items", healthcheck.CycleReport{OmnikeeperReachable: true, ItemsFetched: 2, ItemsFailed: 1}, false, ExitCodeItemsFailed},
+		{"items in backoff", healthcheck.CycleReport{OmnikeeperReachable: true, Successful: true, ItemsFetched: 2, ItemsFailed: 1}, false, ExitCodeItemsFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, CycleSummary{CycleReport: test.report, NotStarted: test.notStarted}.ExitCode())
+		})
+	}
+}
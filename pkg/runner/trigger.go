@@ -0,0 +1,64 @@
+package runner
+
+import "sync"
+
+// cycleTrigger requests cycles outside of the regular collect interval
+// cycles are always run by the main loop, so triggered cycles never overlap; requests made while a cycle is pending are coalesced
+type cycleTrigger struct {
+	c chan struct{}
+
+	mutex  sync.Mutex
+	forced map[string]bool
+}
+
+func newCycleTrigger() *cycleTrigger {
+	return &cycleTrigger{
+		c:      make(chan struct{}, 1),
+		forced: make(map[string]bool),
+	}
+}
+
+func (t *cycleTrigger) Trigger() {
+	select {
+	case t.c <- struct{}{}:
+	default:
+	}
+}
+
+// Force requests a cycle in which the item is run even if its data is unchanged
+func (t *cycleTrigger) Force(id string) {
+	t.mutex.Lock()
+	t.forced[id] = true
+	t.mutex.Unlock()
+	t.Trigger()
+}
+
+// IsForced returns whether the item is forced to run in the next cycle
+func (t *cycleTrigger) IsForced(id string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.forced[id]
+}
+
+// TakeForced returns the IDs of all forced items and resets them, called at the start of a cycle
+func (t *cycleTrigger) TakeForced() map[string]bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	forced := t.forced
+	t.forced = make(map[string]bool)
+	return forced
+}
+
+// Requeue forces the items again after a cycle that failed before running them
+// NOTE: no cycle is triggered, so a failing cycle is retried in the collect interval instead of right away
+func (t *cycleTrigger) Requeue(forced map[string]bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id := range forced {
+		t.forced[id] = true
+	}
+}
+
+func (t *cycleTrigger) C() <-chan struct{} {
+	return t.c
+}
@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"context"
+
+	"github.com/hasura/go-graphql-client"
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/omnikeeper"
+)
+
+// writeBackResults writes the results of all items that were run in this cycle to omnikeeper and returns the write-back errors per item
+// items that were held back because of earlier failures are not written, their last result is still in omnikeeper
+func (a *Agent) writeBackResults(ctx context.Context, client *graphql.Client, results map[string]ProcessResultItem) map[string]error {
+	cfg, log := a.cfg.WriteBack, a.log
+	deployments := make(map[string]omnikeeper.DeploymentResult, len(results))
+	for id, result := range results {
+		if result.Status != ItemStatusSucceeded && result.Status != ItemStatusFailed {
+			continue
+		}
+		deployments[id] = omnikeeper.DeploymentResult{
+			Time:          result.Finished,
+			Success:       result.Success,
+			Logs:          result.Logs,
+			VariablesHash: result.VariablesHash,
+		}
+	}
+	if len(deployments) == 0 {
+		return nil
+	}
+
+	log.Debugf("Writing back results of %d items to layer %s...", len(deployments), cfg.Layer)
+	errs := omnikeeper.NewWriteBack(client, cfg).Write(ctx, deployments)
+	for id, err := range errs {
+		log.Errorf("Error writing back result of item %s: %v", id, err)
+	}
+	a.metrics.WriteBackErrors.Add(float64(len(errs)))
+	log.Debugf("Finished writing back results")
+	return errs
+}
@@ -0,0 +1,228 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/max-bytes/omnikeeper-deploy-agent/v2/pkg/fsutil"
+)
+
+// Filename is the name of the state file inside the output directory
+const Filename = ".okda-state.json"
+
+const stateVersion = 1
+
+// ItemState is the persisted processing state of a single item
+type ItemState struct {
+	ContentHash       string    `json:"content_hash"` // hash of the variables that were last applied successfully
+	LastSuccessfulRun time.Time `json:"last_successful_run"`
+	LastAttempt       time.Time `json:"last_attempt"`
+	FailureCount      int       `json:"failure_count"` // consecutive failures with the same content
+	LastError         string    `json:"last_error,omitempty"`
+	FailedContentHash string    `json:"failed_content_hash,omitempty"` // hash of the variables of the last failed run
+	NextAttempt       time.Time `json:"next_attempt"`                  // failed items are not retried before this time
+	Files             []string  `json:"files,omitempty"`               // variables files of the item inside the output directory, only these are deleted when the item is removed
+	RemovedAt         time.Time `json:"removed_at"`                    // the item is not returned by the processor since this time, zero while it is present
+}
+
+// Decision tells whether an item needs to be run
+type Decision int
+
+const (
+	Unchanged   Decision = iota // item was applied successfully with the same content
+	Run                         // item is new, changed or due for a retry
+	Backoff                     // item failed and waits for the next retry
+	Quarantined                 // item failed too often, it is not retried until its content changes
+)
+
+type stateFile struct {
+	Version int                   `json:"version"`
+	Items   map[string]*ItemState `json:"items"`
+}
+
+// Store keeps the state of all items and is the single source of truth for deciding whether an item needs to be (re-)run
+type Store struct {
+	filename string
+	mutex    sync.RWMutex
+	items    map[string]*ItemState
+}
+
+// Load reads the store from filename; a missing file results in an empty store
+func Load(filename string) (*Store, error) {
+	s := &Store{
+		filename: filename,
+		items:    make(map[string]*ItemState),
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading state file: %w", err)
+	}
+
+	var f stateFile
+	err = json.Unmarshal(content, &f)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing state file %s: %w", filename, err)
+	}
+	if f.Version != stateVersion {
+		return nil, fmt.Errorf("Unsupported version %d of state file %s", f.Version, filename)
+	}
+	for id, item := range f.Items {
+		if item != nil {
+			s.items[id] = item
+		}
+	}
+	return s, nil
+}
+
+// Save writes the store to disk, replacing the previous state file atomically
+func (s *Store) Save() error {
+	s.mutex.RLock()
+	content, err := json.MarshalIndent(stateFile{Version: stateVersion, Items: s.items}, "", " ")
+	s.mutex.RUnlock()
+	if err != nil {
+		return fmt.Errorf("Error marshalling state: %w", err)
+	}
+
+	err = fsutil.WriteFileAtomic(s.filename, content, 0600)
+	if err != nil {
+		return fmt.Errorf("Error saving state file: %w", err)
+	}
+	return nil
+}
+
+// HashContent returns the hash that is stored as ItemState.ContentHash
+func HashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Decide returns whether the item with the given content hash needs to be run
+// failed items are retried once their backoff expired, unless they failed quarantineAfter times in a row (0 disables quarantine)
+// a change of content always triggers a run
+func (s *Store) Decide(id string, contentHash string, now time.Time, quarantineAfter int) Decision {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	item, ok := s.items[id]
+	if !ok {
+		return Run
+	}
+	if item.FailureCount == 0 {
+		if item.ContentHash != contentHash {
+			return Run
+		}
+		return Unchanged
+	}
+	if item.FailedContentHash != contentHash {
+		return Run
+	}
+	if quarantineAfter > 0 && item.FailureCount >= quarantineAfter {
+		return Quarantined
+	}
+	if now.Before(item.NextAttempt) {
+		return Backoff
+	}
+	return Run
+}
+
+func (s *Store) RecordSuccess(id string, contentHash string, t time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item := s.getOrCreate(id)
+	item.ContentHash = contentHash
+	item.LastSuccessfulRun = t
+	item.LastAttempt = t
+	item.FailureCount = 0
+	item.LastError = ""
+	item.FailedContentHash = ""
+	item.NextAttempt = time.Time{}
+}
+
+// RecordFailure records a failed run, consecutive failures are only counted while the content stays the same
+// backoff returns the delay until the next retry for the updated number of consecutive failures
+func (s *Store) RecordFailure(id string, contentHash string, err error, t time.Time, backoff func(failureCount int) time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item := s.getOrCreate(id)
+	if item.FailedContentHash != contentHash {
+		item.FailureCount = 0
+	}
+	item.LastAttempt = t
+	item.FailureCount++
+	item.LastError = err.Error()
+	item.FailedContentHash = contentHash
+	item.NextAttempt = t.Add(backoff(item.FailureCount))
+}
+
+// Set replaces the state of an item, used when migrating from older on-disk formats
+func (s *Store) Set(id string, item ItemState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.items[id] = &item
+}
+
+// SetFiles records the variables files of an item that is returned by the processor, a pending removal of the item is cancelled
+func (s *Store) SetFiles(id string, files []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item := s.getOrCreate(id)
+	item.Files = files
+	item.RemovedAt = time.Time{}
+}
+
+// MarkRemoved records that the item is not returned by the processor anymore and returns since when it is missing
+func (s *Store) MarkRemoved(id string, t time.Time) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item := s.getOrCreate(id)
+	if item.RemovedAt.IsZero() {
+		item.RemovedAt = t
+	}
+	return item.RemovedAt
+}
+
+func (s *Store) Get(id string) (ItemState, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	item, ok := s.items[id]
+	if !ok {
+		return ItemState{}, false
+	}
+	return *item, true
+}
+
+func (s *Store) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.items, id)
+}
+
+// IDs returns the sorted IDs of all items in the store
+func (s *Store) IDs() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := make([]string, 0, len(s.items))
+	for id := range s.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Store) getOrCreate(id string) *ItemState {
+	item, ok := s.items[id]
+	if !ok {
+		item = &ItemState{}
+		s.items[id] = item
+	}
+	return item
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecide(t *testing.T) {
+	store, err := Load(filepath.Join(t.TempDir(), Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	backoff := func(failureCount int) time.Duration {
+		return time.Duration(failureCount) * time.Minute
+	}
+
+	assert.Equal(t, Run, store.Decide("a", "hash1", now, 0), "unknown item")
+
+	store.RecordSuccess("a", "hash1", now)
+	assert.Equal(t, Unchanged, store.Decide("a", "hash1", now, 0), "unchanged item")
+	assert.Equal(t, Run, store.Decide("a", "hash2", now, 0), "changed item")
+
+	store.RecordFailure("a", "hash2", errors.New("failed"), now, backoff)
+	assert.Equal(t, Backoff, store.Decide("a", "hash2", now, 0), "failed item before next attempt")
+	assert.Equal(t, Run, store.Decide("a", "hash2", now.Add(time.Minute), 0), "failed item after next attempt")
+	assert.Equal(t, Run, store.Decide("a", "hash3", now, 0), "failed item with changed content")
+	item, _ := store.Get("a")
+	assert.Equal(t, 1, item.FailureCount)
+	assert.Equal(t, "failed", item.LastError)
+
+	store.RecordFailure("a", "hash2", errors.New("failed again"), now, backoff)
+	item, _ = store.Get("a")
+	assert.Equal(t, 2, item.FailureCount)
+	assert.Equal(t, now.Add(2*time.Minute), item.NextAttempt)
+	assert.Equal(t, Quarantined, store.Decide("a", "hash2", now.Add(time.Hour), 2), "quarantined item")
+	assert.Equal(t, Run, store.Decide("a", "hash3", now, 2), "quarantined item with changed content")
+
+	store.RecordFailure("a", "hash3", errors.New("failed with new content"), now, backoff)
+	item, _ = store.Get("a")
+	assert.Equal(t, 1, item.FailureCount, "failure count restarts with changed content")
+
+	store.RecordSuccess("a", "hash3", now)
+	item, _ = store.Get("a")
+	assert.Equal(t, 0, item.FailureCount)
+	assert.Equal(t, "", item.LastError)
+	assert.Equal(t, Unchanged, store.Decide("a", "hash3", now, 2))
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), Filename)
+	store, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	store.RecordSuccess("a", "hash1", now)
+	store.RecordFailure("b", "hash2", errors.New("failed"), now, func(int) time.Duration { return time.Minute })
+	err = store.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"a", "b"}, loaded.IDs())
+	a, _ := loaded.Get("a")
+	assert.Equal(t, ItemState{ContentHash: "hash1", LastSuccessfulRun: now, LastAttempt: now}, a)
+	b, _ := loaded.Get("b")
+	assert.Equal(t, ItemState{LastAttempt: now, FailureCount: 1, LastError: "failed", FailedContentHash: "hash2", NextAttempt: now.Add(time.Minute)}, b)
+}
+
+func TestMarkRemoved(t *testing.T) {
+	store, err := Load(filepath.Join(t.TempDir(), Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.SetFiles("a", []string{"a.json"})
+
+	assert.Equal(t, now, store.MarkRemoved("a", now))
+	assert.Equal(t, now, store.MarkRemoved("a", now.Add(time.Minute)), "the first time the item was missing is kept")
+
+	store.SetFiles("a", []string{"a.json"})
+	item, _ := store.Get("a")
+	assert.True(t, item.RemovedAt.IsZero(), "the removal is cancelled when the item is returned again")
+	assert.Equal(t, []string{"a.json"}, item.Files)
+}
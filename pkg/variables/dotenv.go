@@ -0,0 +1,126 @@
+package variables
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dotenvEncoder writes KEY=value lines, sorted by key
+// nested keys are joined with underscores and list elements get their index, e.g. SERVERS_0_NAME for {"servers": [{"name": ...}]}
+// keys are upper case with all characters except letters, digits and underscores replaced by underscores
+// strings are double quoted with backslash escapes, null is an empty value
+type dotenvEncoder struct{}
+
+func (dotenvEncoder) Encode(value interface{}) ([]byte, error) {
+	tree, err := canonicalize(value)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return nil, errors.New("dotenv needs an object at the top level")
+	}
+
+	lines := make(map[string]string)
+	sources := make(map[string]string)
+	err = flattenDotenv("", "", tree, lines, sources)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(lines))
+	for key := range lines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteString("=")
+		b.WriteString(lines[key])
+		b.WriteString("\n")
+	}
+	return []byte(b.String()), nil
+}
+
+func (dotenvEncoder) Extension() string {
+	return ".env"
+}
+
+// flattenDotenv adds a line for every scalar of value, path is the original path of value for error messages
+func flattenDotenv(key string, path string, value interface{}, lines map[string]string, sources map[string]string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for childKey, element := range v {
+			err := flattenDotenv(joinDotenvKey(key, dotenvKey(childKey)), joinPath(path, childKey), element, lines, sources)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for i, element := range v {
+			err := flattenDotenv(joinDotenvKey(key, strconv.Itoa(i)), joinPath(path, strconv.Itoa(i)), element, lines, sources)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if other, ok := sources[key]; ok {
+		return fmt.Errorf("%s and %s both map to the dotenv key %s", other, path, key)
+	}
+	sources[key] = path
+	switch v := value.(type) {
+	case string:
+		lines[key] = quoteDotenv(v)
+	case json.Number:
+		lines[key] = v.String()
+	case bool:
+		lines[key] = strconv.FormatBool(v)
+	default:
+		lines[key] = ""
+	}
+	return nil
+}
+
+func dotenvKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+func joinDotenvKey(prefix string, key string) string {
+	if prefix == "" {
+		// NOTE: variable names must not start with a digit
+		if key == "" || (key[0] >= '0' && key[0] <= '9') {
+			return "_" + key
+		}
+		return key
+	}
+	return prefix + "_" + key
+}
+
+func joinPath(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+
+func quoteDotenv(value string) string {
+	return `"` + dotenvEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,89 @@
+package variables
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// formats of the variables files, see config output_format
+const (
+	FormatJSON   = "json"
+	FormatYAML   = "yaml"
+	FormatDotenv = "dotenv"
+)
+
+// Encoder writes the variables of an item to the content of its variables file
+// the encoding is deterministic, i.e. equal variables always result in the same content, so the content hash can be used for change detection
+type Encoder interface {
+	Encode(value interface{}) ([]byte, error)
+	Extension() string // suffix of the variables file, including the dot
+}
+
+// NewEncoder returns the encoder of format, an empty format is JSON
+func NewEncoder(format string) (Encoder, error) {
+	switch format {
+	case FormatJSON, "":
+		return jsonEncoder{}, nil
+	case FormatYAML:
+		return yamlEncoder{}, nil
+	case FormatDotenv:
+		return dotenvEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be one of %s, %s or %s", format, FormatJSON, FormatYAML, FormatDotenv)
+	}
+}
+
+// canonicalize converts value to a tree of maps, slices and scalars like encoding/json would see it
+// structs are converted according to their json tags, numbers are json.Number with a canonical representation
+func canonicalize(value interface{}) (interface{}, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var tree interface{}
+	err = decoder.Decode(&tree)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalizeNumbers(tree), nil
+}
+
+func canonicalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = canonicalizeNumbers(element)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = canonicalizeNumbers(element)
+		}
+	case json.Number:
+		return canonicalNumber(v)
+	}
+	return value
+}
+
+// canonicalNumber formats integers without fraction or exponent and all other numbers like encoding/json formats a float64
+// NOTE: numbers from json.Number or json.RawMessage values may use other representations of the same value, e.g. 1.0 or 1e0
+func canonicalNumber(n json.Number) json.Number {
+	if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil {
+		return json.Number(strconv.FormatInt(i, 10))
+	}
+	if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+		return json.Number(strconv.FormatUint(u, 10))
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return n
+	}
+	formatted, err := json.Marshal(f)
+	if err != nil {
+		return n
+	}
+	return json.Number(formatted)
+}
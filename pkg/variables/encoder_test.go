@@ -0,0 +1,114 @@
+package variables
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type server struct {
+	Name  string   `json:"name"`
+	Port  int      `json:"port"`
+	Alias []string `json:"alias"`
+}
+
+var testVariables = map[string]interface{}{
+	"name":    "host-a",
+	"enabled": true,
+	"weight":  0.5,
+	"count":   json.Number("3.0"),
+	"note":    nil,
+	"servers": []server{{Name: "web", Port: 8080, Alias: []string{"www"}}},
+}
+
+func encode(t *testing.T, format string, value interface{}) string {
+	encoder, err := NewEncoder(format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := encoder.Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestJSONEncoder(t *testing.T) {
+	assert.Equal(t, `{
+ "count": 3.0,
+ "enabled": true,
+ "name": "host-a",
+ "note": null,
+ "servers": [
+  {
+   "name": "web",
+   "port": 8080,
+   "alias": [
+    "www"
+   ]
+  }
+ ],
+ "weight": 0.5
+}`, encode(t, FormatJSON, testVariables))
+
+	// maps and structs are encoded like in earlier versions, so their content hashes do not change
+	for _, value := range []interface{}{
+		map[string]interface{}{"b": 1, "a": "x<y"},
+		server{Name: "web", Port: 8080, Alias: []string{"www"}},
+	} {
+		legacy, err := json.MarshalIndent(value, "", " ")
+		assert.NoError(t, err)
+		assert.Equal(t, string(legacy), encode(t, "", value))
+	}
+}
+
+func TestYAMLEncoder(t *testing.T) {
+	assert.Equal(t, `count: 3
+enabled: true
+name: host-a
+note: null
+servers:
+  - alias:
+      - www
+    name: web
+    port: 8080
+weight: 0.5
+`, encode(t, FormatYAML, testVariables))
+
+	// strings that look like other types stay strings
+	assert.Equal(t, "a: \"123\"\nb: \"true\"\n", encode(t, FormatYAML, map[string]string{"a": "123", "b": "true"}))
+}
+
+func TestDotenvEncoder(t *testing.T) {
+	assert.Equal(t, `COUNT=3
+ENABLED=true
+NAME="host-a"
+NOTE=
+SERVERS_0_ALIAS_0="www"
+SERVERS_0_NAME="web"
+SERVERS_0_PORT=8080
+WEIGHT=0.5
+`, encode(t, FormatDotenv, testVariables))
+
+	assert.Equal(t, "MY_KEY=\"say \\\"hi\\\"\\n\\$HOME\"\n_1ST=1\n", encode(t, FormatDotenv, map[string]interface{}{"my-key": "say \"hi\"\n$HOME", "1st": 1}))
+
+	encoder, _ := NewEncoder(FormatDotenv)
+	_, err := encoder.Encode(map[string]interface{}{"a_b": 1, "a.b": 2})
+	assert.Error(t, err)
+	_, err = encoder.Encode("scalar")
+	assert.Error(t, err)
+}
+
+func TestEncodingIsCanonical(t *testing.T) {
+	// NOTE: JSON keeps the bytes of earlier versions, see jsonEncoder
+	for _, format := range []string{FormatYAML, FormatDotenv} {
+		// numbers with different representations of the same value are encoded the same
+		assert.Equal(t, encode(t, format, map[string]interface{}{"n": 10, "f": 1.5}), encode(t, format, map[string]interface{}{"n": json.Number("1e1"), "f": json.Number("1.50")}), format)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := NewEncoder("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+package variables
+
+import (
+	"encoding/json"
+)
+
+// jsonEncoder writes indented JSON, map keys are sorted and struct fields keep their order
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(value interface{}) ([]byte, error) {
+	// NOTE: exactly the bytes of earlier versions, so content hashes of existing items, including structs, survive upgrades
+	return json.MarshalIndent(value, "", " ")
+}
+
+func (jsonEncoder) Extension() string {
+	return ".json"
+}